@@ -0,0 +1,194 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster"
+	"github.com/etcd-io/etcdlabs/cluster/clusterpb"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Backend is the etcd cluster that the web server operates on.
+type Backend interface {
+	// Started returns the time when the cluster was started.
+	Started() time.Time
+	// Size returns the number of members.
+	Size() int
+	// Quorum returns the number of members needed for quorum.
+	Quorum() int
+	// ActiveNodeN returns the number of running members.
+	ActiveNodeN() int
+
+	// Member returns the member by its name or ID (in hex).
+	Member(key string) (MemberInfo, error)
+	// FindMember returns the member by its client URL, with or without scheme.
+	FindMember(ep string) (MemberInfo, error)
+
+	// KV returns the key-value client of the endpoints, or of any
+	// running member if none is given.
+	// The client is shared, so the caller must not close it.
+	KV(eps ...string) (clientv3.KV, error)
+	// BalancedKV returns the key-value client that connects to all the
+	// endpoints through the client balancer, so that requests fail over
+	// to the other endpoints when the serving member stops.
+	// The client is shared, so the caller must not close it.
+	BalancedKV(eps ...string) (clientv3.KV, error)
+	// Watcher returns the watch client of the endpoints, or of any
+	// running member if none is given. The client is shared, so the
+	// caller must cancel its watches instead of closing it.
+	Watcher(eps ...string) (clientv3.Watcher, error)
+	// Lease returns the lease client of the endpoints, or of any
+	// running member if none is given. The client is shared, so the
+	// caller must not close it.
+	Lease(eps ...string) (clientv3.Lease, error)
+
+	// Stop stops the member by its name or ID.
+	Stop(ctx context.Context, key string) error
+	// Restart restarts the stopped member by its name or ID.
+	Restart(ctx context.Context, key string) error
+	// Replace replaces the member with a new one of the same name.
+	Replace(ctx context.Context, key string) (MemberInfo, error)
+
+	// UpdateMemberStatus refreshes the member statuses.
+	UpdateMemberStatus(ctx context.Context)
+	// AllMemberStatus returns the latest member statuses.
+	AllMemberStatus() []clusterpb.MemberStatus
+
+	// Shutdown releases the backend.
+	Shutdown(ctx context.Context) error
+}
+
+// MemberInfo is a snapshot of a backend member.
+type MemberInfo struct {
+	Name string
+	ID   string // in hex
+
+	// Endpoints are the client URLs with scheme.
+	Endpoints []string
+	Stopped   bool
+}
+
+// ErrNotSupported is returned when the backend does not support the operation.
+var ErrNotSupported = errors.New("not supported by the backend")
+
+// NewEmbeddedBackend returns the backend of an embedded cluster.
+func NewEmbeddedBackend(clus *cluster.Cluster) Backend {
+	return &embeddedBackend{clus: clus}
+}
+
+type embeddedBackend struct {
+	clus *cluster.Cluster
+}
+
+func toMemberInfo(m *cluster.Member) MemberInfo {
+	return MemberInfo{
+		Name:      m.Name(),
+		ID:        m.ID().String(),
+		Endpoints: m.Endpoints(true),
+		Stopped:   m.IsStopped(),
+	}
+}
+
+func (b *embeddedBackend) Started() time.Time { return b.clus.Started }
+func (b *embeddedBackend) Size() int          { return b.clus.Size() }
+func (b *embeddedBackend) Quorum() int        { return b.clus.Quorum() }
+func (b *embeddedBackend) ActiveNodeN() int   { return b.clus.ActiveNodeN() }
+
+func (b *embeddedBackend) Member(key string) (MemberInfo, error) {
+	m, err := b.clus.Member(key)
+	if err != nil {
+		return MemberInfo{}, err
+	}
+	return toMemberInfo(m), nil
+}
+
+func (b *embeddedBackend) FindMember(ep string) (MemberInfo, error) {
+	m, err := b.clus.FindMember(ep)
+	if err != nil {
+		return MemberInfo{}, err
+	}
+	return toMemberInfo(m), nil
+}
+
+func (b *embeddedBackend) KV(eps ...string) (clientv3.KV, error) {
+	return b.client(eps...)
+}
+
+func (b *embeddedBackend) BalancedKV(eps ...string) (clientv3.KV, error) {
+	return b.clus.BalancedClient(eps...)
+}
+
+func (b *embeddedBackend) Watcher(eps ...string) (clientv3.Watcher, error) {
+	return b.client(eps...)
+}
+
+func (b *embeddedBackend) Lease(eps ...string) (clientv3.Lease, error) {
+	return b.client(eps...)
+}
+
+func (b *embeddedBackend) client(eps ...string) (*clientv3.Client, error) {
+	if len(eps) == 0 {
+		for _, m := range b.clus.AllMembers() {
+			if !m.IsStopped() {
+				eps = append(eps, m.Endpoints(true)...)
+			}
+		}
+	}
+	return b.clus.PooledClient(eps...)
+}
+
+func (b *embeddedBackend) Stop(ctx context.Context, key string) error {
+	return b.clus.Stop(ctx, key)
+}
+
+func (b *embeddedBackend) Restart(ctx context.Context, key string) error {
+	return b.clus.Restart(ctx, key)
+}
+
+func (b *embeddedBackend) Replace(ctx context.Context, key string) (MemberInfo, error) {
+	m, err := b.clus.Replace(ctx, key)
+	if err != nil {
+		return MemberInfo{}, err
+	}
+	return toMemberInfo(m), nil
+}
+
+func (b *embeddedBackend) UpdateMemberStatus(ctx context.Context) {
+	b.clus.UpdateMemberStatus(ctx)
+}
+
+func (b *embeddedBackend) AllMemberStatus() []clusterpb.MemberStatus {
+	return b.clus.AllMemberStatus()
+}
+
+func (b *embeddedBackend) Shutdown(ctx context.Context) error {
+	return b.clus.Shutdown(ctx)
+}
+
+// endpointHost returns the host of the endpoint, with or without scheme.
+func endpointHost(ep string) string {
+	u, err := url.Parse(ep)
+	if err != nil || !strings.Contains(ep, "://") {
+		return ep
+	}
+	return u.Host
+}
@@ -0,0 +1,441 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster"
+	"github.com/etcd-io/etcdlabs/cluster/clusterpb"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/pkg/types"
+)
+
+// NewFakeBackend returns an in-memory backend of the given size,
+// without running etcd. Useful for testing handlers.
+func NewFakeBackend(size int) Backend {
+	b := &fakeBackend{
+		started: time.Now(),
+		kvs:     make(map[string]*mvccpb.KeyValue),
+	}
+	for i := 0; i < size; i++ {
+		b.members = append(b.members, &fakeMember{
+			name: fmt.Sprintf("node%d", i+1),
+			id:   types.ID(rand.Uint64()),
+			ep:   fmt.Sprintf("http://node%d.fake:2379", i+1),
+		})
+	}
+	if size > 0 {
+		b.members[0].leader = true
+	}
+	return b
+}
+
+type fakeMember struct {
+	name    string
+	id      types.ID
+	ep      string
+	stopped bool
+	leader  bool
+}
+
+func (m *fakeMember) info() MemberInfo {
+	return MemberInfo{Name: m.name, ID: m.id.String(), Endpoints: []string{m.ep}, Stopped: m.stopped}
+}
+
+type fakeBackend struct {
+	mu      sync.RWMutex
+	started time.Time
+	members []*fakeMember
+
+	rev int64
+	kvs map[string]*mvccpb.KeyValue
+}
+
+func (b *fakeBackend) Started() time.Time { return b.started }
+
+func (b *fakeBackend) Size() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.members)
+}
+
+func (b *fakeBackend) Quorum() int {
+	return b.Size()/2 + 1
+}
+
+func (b *fakeBackend) ActiveNodeN() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.activeNodeN()
+}
+
+// activeNodeN must be called with 'mu' locked.
+func (b *fakeBackend) activeNodeN() (cnt int) {
+	for _, m := range b.members {
+		if !m.stopped {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (b *fakeBackend) member(key string) (*fakeMember, error) {
+	for _, m := range b.members {
+		if m.name == key || m.id.String() == key {
+			return m, nil
+		}
+	}
+	return nil, cluster.ErrMemberNotFound
+}
+
+func (b *fakeBackend) findMember(ep string) (*fakeMember, error) {
+	for _, m := range b.members {
+		if endpointHost(m.ep) == endpointHost(ep) {
+			return m, nil
+		}
+	}
+	return nil, cluster.ErrMemberNotFound
+}
+
+func (b *fakeBackend) Member(key string) (MemberInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	m, err := b.member(key)
+	if err != nil {
+		return MemberInfo{}, err
+	}
+	return m.info(), nil
+}
+
+func (b *fakeBackend) FindMember(ep string) (MemberInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	m, err := b.findMember(ep)
+	if err != nil {
+		return MemberInfo{}, err
+	}
+	return m.info(), nil
+}
+
+func (b *fakeBackend) KV(eps ...string) (clientv3.KV, error) {
+	if len(eps) == 0 {
+		return &fakeKV{b: b}, nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var ms []*fakeMember
+	for _, ep := range eps {
+		m, err := b.findMember(ep)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return &fakeKV{b: b, members: ms}, nil
+}
+
+// BalancedKV is the same as KV, whose requests are served by any
+// running member of the endpoints.
+func (b *fakeBackend) BalancedKV(eps ...string) (clientv3.KV, error) {
+	return b.KV(eps...)
+}
+
+// Watcher is not supported, since the fake backend keeps no history.
+func (b *fakeBackend) Watcher(eps ...string) (clientv3.Watcher, error) {
+	return nil, ErrNotSupported
+}
+
+// Lease is not supported, since the fake backend keeps no expiry.
+func (b *fakeBackend) Lease(eps ...string) (clientv3.Lease, error) {
+	return nil, ErrNotSupported
+}
+
+// elect makes the first running member the leader, if the current leader stopped.
+// It must be called with 'mu' locked.
+func (b *fakeBackend) elect() {
+	for _, m := range b.members {
+		if m.leader && !m.stopped {
+			return
+		}
+		m.leader = false
+	}
+	if b.activeNodeN() < len(b.members)/2+1 {
+		return
+	}
+	for _, m := range b.members {
+		if !m.stopped {
+			m.leader = true
+			return
+		}
+	}
+}
+
+func (b *fakeBackend) Stop(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, err := b.member(key)
+	if err != nil {
+		return err
+	}
+	if m.stopped {
+		return cluster.ErrMemberStopped
+	}
+	m.stopped = true
+	b.elect()
+	return nil
+}
+
+func (b *fakeBackend) Restart(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, err := b.member(key)
+	if err != nil {
+		return err
+	}
+	m.stopped = false
+	b.elect()
+	return nil
+}
+
+func (b *fakeBackend) Replace(ctx context.Context, key string) (MemberInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, err := b.member(key)
+	if err != nil {
+		return MemberInfo{}, err
+	}
+	m.id = types.ID(rand.Uint64())
+	m.stopped = false
+	b.elect()
+	return m.info(), nil
+}
+
+func (b *fakeBackend) UpdateMemberStatus(ctx context.Context) {}
+
+func (b *fakeBackend) AllMemberStatus() []clusterpb.MemberStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	sts := make([]clusterpb.MemberStatus, 0, len(b.members))
+	for _, m := range b.members {
+		st := clusterpb.MemberStatus{
+			Name:     m.name,
+			ID:       m.id.String(),
+			Endpoint: m.ep,
+			IsLeader: m.leader,
+			State:    clusterpb.FollowerMemberStatus,
+			StateTxt: fmt.Sprintf("%s is running (fake)", m.name),
+		}
+		switch {
+		case m.stopped:
+			st.State = clusterpb.StoppedMemberStatus
+			st.StateTxt = fmt.Sprintf("%s is stopped (fake)", m.name)
+		case m.leader:
+			st.State = clusterpb.LeaderMemberStatus
+		}
+		sts = append(sts, st)
+	}
+	return sts
+}
+
+func (b *fakeBackend) Shutdown(ctx context.Context) error { return nil }
+
+// fakeKV is the in-memory key-value client of the fake backend.
+// It fails when none of its members are running, like a real client.
+type fakeKV struct {
+	b       *fakeBackend
+	members []*fakeMember
+}
+
+func (kv *fakeKV) check() error {
+	if len(kv.members) == 0 {
+		return nil
+	}
+	for _, m := range kv.members {
+		if !m.stopped {
+			return nil
+		}
+	}
+	return cluster.ErrMemberStopped
+}
+
+// header returns the response header, served by the first running member.
+// It must be called with 'mu' locked.
+func (kv *fakeKV) header() *pb.ResponseHeader {
+	h := &pb.ResponseHeader{Revision: kv.b.rev}
+	ms := kv.members
+	if len(ms) == 0 {
+		ms = kv.b.members
+	}
+	for _, m := range ms {
+		if !m.stopped {
+			h.MemberId = uint64(m.id)
+			break
+		}
+	}
+	return h
+}
+
+// inRange returns true if the key is in the range of the operation.
+func inRange(op clientv3.Op, key []byte) bool {
+	end := op.RangeBytes()
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, op.KeyBytes())
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(key, op.KeyBytes()) >= 0
+	default:
+		return bytes.Compare(key, op.KeyBytes()) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+// rangeKeys returns the key-values in the range, sorted by key.
+// It must be called with 'mu' locked.
+func (kv *fakeKV) rangeKeys(op clientv3.Op) []*mvccpb.KeyValue {
+	var kvs []*mvccpb.KeyValue
+	for k, v := range kv.b.kvs {
+		if inRange(op, []byte(k)) {
+			kvs = append(kvs, v)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs
+}
+
+func (kv *fakeKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	return kv.put(clientv3.OpPut(key, val, opts...))
+}
+
+func (kv *fakeKV) put(op clientv3.Op) (*clientv3.PutResponse, error) {
+	kv.b.mu.Lock()
+	defer kv.b.mu.Unlock()
+	if err := kv.check(); err != nil {
+		return nil, err
+	}
+
+	key := string(op.KeyBytes())
+	kv.b.rev++
+	nv := &mvccpb.KeyValue{Key: []byte(key), Value: op.ValueBytes(), CreateRevision: kv.b.rev, ModRevision: kv.b.rev, Version: 1}
+	prev, ok := kv.b.kvs[key]
+	if ok {
+		nv.CreateRevision, nv.Version = prev.CreateRevision, prev.Version+1
+	}
+	kv.b.kvs[key] = nv
+	return &clientv3.PutResponse{Header: kv.header(), PrevKv: prev}, nil
+}
+
+func (kv *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return kv.get(clientv3.OpGet(key, opts...))
+}
+
+// get ignores the limit and sort options, which are not visible outside clientv3.
+func (kv *fakeKV) get(op clientv3.Op) (*clientv3.GetResponse, error) {
+	kv.b.mu.RLock()
+	defer kv.b.mu.RUnlock()
+	if err := kv.check(); err != nil {
+		return nil, err
+	}
+
+	if rev := op.Rev(); rev > 0 && rev != kv.b.rev {
+		return nil, ErrNotSupported // no history
+	}
+	kvs := kv.rangeKeys(op)
+	resp := &clientv3.GetResponse{Header: kv.header(), Count: int64(len(kvs))}
+	switch {
+	case op.IsCountOnly():
+	default:
+		// copy the key-values, since the client may modify the response
+		for _, v := range kvs {
+			nv := *v
+			if op.IsKeysOnly() {
+				nv.Value = nil
+			}
+			resp.Kvs = append(resp.Kvs, &nv)
+		}
+	}
+	return resp, nil
+}
+
+func (kv *fakeKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	return kv.del(clientv3.OpDelete(key, opts...))
+}
+
+func (kv *fakeKV) del(op clientv3.Op) (*clientv3.DeleteResponse, error) {
+	kv.b.mu.Lock()
+	defer kv.b.mu.Unlock()
+	if err := kv.check(); err != nil {
+		return nil, err
+	}
+
+	kvs := kv.rangeKeys(op)
+	if len(kvs) > 0 {
+		kv.b.rev++
+	}
+	for _, v := range kvs {
+		delete(kv.b.kvs, string(v.Key))
+	}
+	return &clientv3.DeleteResponse{Header: kv.header(), Deleted: int64(len(kvs)), PrevKvs: kvs}, nil
+}
+
+func (kv *fakeKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return nil, ErrNotSupported
+}
+
+// Do supports all operations but transactions.
+func (kv *fakeKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	switch {
+	case op.IsPut():
+		resp, err := kv.put(op)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		return resp.OpResponse(), nil
+	case op.IsGet():
+		resp, err := kv.get(op)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		return resp.OpResponse(), nil
+	case op.IsDelete():
+		resp, err := kv.del(op)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		return resp.OpResponse(), nil
+	}
+	return clientv3.OpResponse{}, ErrNotSupported
+}
+
+func (kv *fakeKV) Txn(ctx context.Context) clientv3.Txn {
+	return fakeTxn{}
+}
+
+type fakeTxn struct{}
+
+func (t fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return t }
+func (t fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn { return t }
+func (t fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn { return t }
+func (t fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,338 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster"
+	"github.com/etcd-io/etcdlabs/cluster/clusterpb"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/types"
+	humanize "github.com/dustin/go-humanize"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// NewRemoteBackend returns the backend of an existing etcd cluster.
+// It is read-mostly: keys can be read and written, but members cannot
+// be stopped, restarted or replaced.
+func NewRemoteBackend(ctx context.Context, ccfg clientv3.Config) (Backend, error) {
+	cli, err := clientv3.New(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	b := &remoteBackend{
+		ccfg:    ccfg,
+		cli:     cli,
+		clients: make(map[string]*clientv3.Client),
+		conns:   make(map[string]*grpc.ClientConn),
+		started: time.Now(),
+	}
+	if err = b.updateMembers(ctx); err != nil {
+		cli.Close()
+		return nil, err
+	}
+	b.UpdateMemberStatus(ctx)
+	return b, nil
+}
+
+type remoteBackend struct {
+	ccfg    clientv3.Config
+	cli     *clientv3.Client
+	started time.Time
+
+	mu       sync.RWMutex
+	members  []MemberInfo
+	statuses []clusterpb.MemberStatus
+
+	clientsMu sync.Mutex
+	clients   map[string]*clientv3.Client
+	// conns are the status connections by endpoint
+	conns map[string]*grpc.ClientConn
+}
+
+// updateMembers refreshes the membership from the cluster.
+func (b *remoteBackend) updateMembers(ctx context.Context) error {
+	resp, err := b.cli.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	ms := make([]MemberInfo, 0, len(resp.Members))
+	for _, m := range resp.Members {
+		ms = append(ms, MemberInfo{
+			Name:      m.Name,
+			ID:        types.ID(m.ID).String(),
+			Endpoints: m.ClientURLs,
+		})
+	}
+
+	b.mu.Lock()
+	// keep the stopped state from the last status update
+	for i := range ms {
+		for _, st := range b.statuses {
+			if st.ID == ms[i].ID {
+				ms[i].Stopped = st.State == clusterpb.StoppedMemberStatus
+			}
+		}
+	}
+	b.members = ms
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *remoteBackend) Started() time.Time { return b.started }
+
+func (b *remoteBackend) Size() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.members)
+}
+
+func (b *remoteBackend) Quorum() int {
+	return b.Size()/2 + 1
+}
+
+func (b *remoteBackend) ActiveNodeN() (cnt int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.members {
+		if !m.Stopped {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func (b *remoteBackend) Member(key string) (MemberInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.members {
+		if m.Name == key || m.ID == key {
+			return m, nil
+		}
+	}
+	return MemberInfo{}, cluster.ErrMemberNotFound
+}
+
+func (b *remoteBackend) FindMember(ep string) (MemberInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, m := range b.members {
+		for _, mep := range m.Endpoints {
+			if endpointHost(mep) == endpointHost(ep) {
+				return m, nil
+			}
+		}
+	}
+	return MemberInfo{}, cluster.ErrMemberNotFound
+}
+
+func (b *remoteBackend) KV(eps ...string) (clientv3.KV, error) {
+	return b.client(eps...)
+}
+
+// BalancedKV is the same as KV, since remote clients always balance
+// over all the endpoints.
+func (b *remoteBackend) BalancedKV(eps ...string) (clientv3.KV, error) {
+	return b.client(eps...)
+}
+
+func (b *remoteBackend) Watcher(eps ...string) (clientv3.Watcher, error) {
+	return b.client(eps...)
+}
+
+func (b *remoteBackend) Lease(eps ...string) (clientv3.Lease, error) {
+	return b.client(eps...)
+}
+
+// client returns the client of the endpoints, created once and reused.
+// With no endpoint, it returns the client of all configured endpoints.
+func (b *remoteBackend) client(eps ...string) (*clientv3.Client, error) {
+	if len(eps) == 0 {
+		return b.cli, nil
+	}
+
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+
+	key := strings.Join(eps, ",")
+	if cli, ok := b.clients[key]; ok {
+		return cli, nil
+	}
+	ccfg := b.ccfg
+	ccfg.Endpoints = eps
+	cli, err := clientv3.New(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	b.clients[key] = cli
+	return cli, nil
+}
+
+func (b *remoteBackend) Stop(ctx context.Context, key string) error {
+	return ErrNotSupported
+}
+
+func (b *remoteBackend) Restart(ctx context.Context, key string) error {
+	return ErrNotSupported
+}
+
+func (b *remoteBackend) Replace(ctx context.Context, key string) (MemberInfo, error) {
+	return MemberInfo{}, ErrNotSupported
+}
+
+// UpdateMemberStatus refreshes the membership, and fetches the status
+// of each member concurrently.
+func (b *remoteBackend) UpdateMemberStatus(ctx context.Context) {
+	if err := b.updateMembers(ctx); err != nil {
+		lg.Warnf("failed to list members (%v)", err)
+	}
+
+	b.mu.RLock()
+	ms := make([]MemberInfo, len(b.members))
+	copy(ms, b.members)
+	b.mu.RUnlock()
+
+	sts := make([]clusterpb.MemberStatus, len(ms))
+	var wg sync.WaitGroup
+	wg.Add(len(ms))
+	for i := range ms {
+		go func(i int) {
+			defer wg.Done()
+			sts[i] = b.fetchStatus(ctx, ms[i])
+		}(i)
+	}
+	wg.Wait()
+	b.closeStatusConns(ms)
+
+	b.mu.Lock()
+	b.statuses = sts
+	for i := range b.members {
+		for _, st := range sts {
+			if st.ID == b.members[i].ID {
+				b.members[i].Stopped = st.State == clusterpb.StoppedMemberStatus
+			}
+		}
+	}
+	b.mu.Unlock()
+}
+
+func (b *remoteBackend) fetchStatus(ctx context.Context, m MemberInfo) clusterpb.MemberStatus {
+	st := clusterpb.MemberStatus{Name: m.Name, ID: m.ID, State: clusterpb.StoppedMemberStatus}
+	if len(m.Endpoints) == 0 {
+		st.StateTxt = fmt.Sprintf("%s has no client endpoint", m.Name)
+		return st
+	}
+	st.Endpoint = m.Endpoints[0]
+
+	now := time.Now()
+	mc, err := b.statusClient(st.Endpoint)
+	if err != nil {
+		st.StateTxt = fmt.Sprintf("%s is not reachable (%s - %v)", m.Name, humanize.Time(now), err)
+		return st
+	}
+	sctx, scancel := context.WithTimeout(ctx, time.Second)
+	resp, err := mc.Status(sctx, &pb.StatusRequest{})
+	scancel()
+	if err != nil {
+		st.StateTxt = fmt.Sprintf("%s is not reachable (%s - %v)", m.Name, humanize.Time(now), err)
+		return st
+	}
+
+	st.State = clusterpb.FollowerMemberStatus
+	if resp.Header.MemberId == resp.Leader {
+		st.IsLeader, st.State = true, clusterpb.LeaderMemberStatus
+	}
+	st.StateTxt = fmt.Sprintf("%s is reachable (remote)", m.Name)
+	st.DBSize = uint64(resp.DbSize)
+	st.DBSizeTxt = humanize.Bytes(uint64(resp.DbSize))
+	return st
+}
+
+// statusClient returns the maintenance client of the endpoint for status
+// polling, on a connection created once and reused. gRPC reconnects the
+// connection when the member restarts.
+func (b *remoteBackend) statusClient(ep string) (pb.MaintenanceClient, error) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+
+	conn, ok := b.conns[ep]
+	if !ok {
+		var dopts = []grpc.DialOption{}
+		if b.ccfg.TLS != nil {
+			dopts = append(dopts, grpc.WithTransportCredentials(credentials.NewTLS(b.ccfg.TLS)))
+		} else {
+			dopts = append(dopts, grpc.WithInsecure())
+		}
+		var err error
+		conn, err = grpc.Dial(endpointHost(ep), dopts...)
+		if err != nil {
+			return nil, err
+		}
+		b.conns[ep] = conn
+	}
+	return pb.NewMaintenanceClient(conn), nil
+}
+
+// closeStatusConns closes the status connections of the endpoints
+// that are no longer in the members.
+func (b *remoteBackend) closeStatusConns(ms []MemberInfo) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+
+	for ep, conn := range b.conns {
+		found := false
+		for _, m := range ms {
+			if len(m.Endpoints) > 0 && m.Endpoints[0] == ep {
+				found = true
+				break
+			}
+		}
+		if !found {
+			conn.Close()
+			delete(b.conns, ep)
+		}
+	}
+}
+
+func (b *remoteBackend) AllMemberStatus() []clusterpb.MemberStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	sts := make([]clusterpb.MemberStatus, len(b.statuses))
+	copy(sts, b.statuses)
+	return sts
+}
+
+// Shutdown closes the clients, leaving the remote cluster running.
+func (b *remoteBackend) Shutdown(ctx context.Context) error {
+	b.clientsMu.Lock()
+	for key, cli := range b.clients {
+		cli.Close()
+		delete(b.clients, key)
+	}
+	for ep, conn := range b.conns {
+		conn.Close()
+		delete(b.conns, ep)
+	}
+	b.clientsMu.Unlock()
+	return b.cli.Close()
+}
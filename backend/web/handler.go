@@ -38,62 +38,97 @@ type userData struct {
 	lastActive time.Time
 }
 
-var (
-	globalUserCacheLock sync.RWMutex
-	globalUserCache     = make(map[string]userData)
-)
-
-var globalStatusInterval = time.Second
-
-func updateClusterStatus(stopc <-chan struct{}) {
+// updateClusterStatus updates member statuses every interval, only
+// while anyone reads them, and notifies the status subscribers.
+func (srv *Server) updateClusterStatus() {
 	for {
 		select {
-		case <-stopc:
+		case <-srv.stopc:
 			return
-		case <-time.After(globalStatusInterval):
+		case <-time.After(srv.cfg.StatusInterval):
+		case <-srv.statusKickc:
 		}
 
-		if len(globalUserCache) == 0 {
+		if !srv.statusWanted() {
 			continue
 		}
-		globalCluster.UpdateMemberStatus()
+		bs := srv.sandboxBackends()
+		if srv.backend != nil {
+			bs = append(bs, srv.backend)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), srv.cfg.StatusTimeout)
+		var wg sync.WaitGroup
+		wg.Add(len(bs))
+		for _, b := range bs {
+			go func(b Backend) {
+				defer wg.Done()
+				b.UpdateMemberStatus(ctx)
+			}(b)
+		}
+		wg.Wait()
+		cancel()
+
+		srv.notifyStatus()
 	}
 }
 
-func cleanCache(stopc <-chan struct{}) {
+func (srv *Server) cleanCache() {
 	for {
 		select {
-		case <-stopc:
+		case <-srv.stopc:
 			return
-		case <-time.After(5 * time.Minute):
+		case <-time.After(srv.cfg.UserCacheInterval):
 		}
 
-		globalUserCacheLock.Lock()
-		for k, v := range globalUserCache {
+		srv.userCacheMu.Lock()
+		for k, v := range srv.userCache {
 			since := time.Since(v.lastActive)
-			if since > 15*time.Minute {
+			if since > srv.cfg.UserInactiveTimeout {
 				lg.Infof("removing inactive user %q (last active %v)", k, since)
-				delete(globalUserCache, k)
+				delete(srv.userCache, k)
 			}
 		}
-		globalUserCacheLock.Unlock()
+		srv.userCacheMu.Unlock()
+
+		// also reclaims the clusters and keys of the users who left
+		active := func(userID string) bool {
+			srv.userCacheMu.RLock()
+			_, ok := srv.userCache[userID]
+			srv.userCacheMu.RUnlock()
+			return ok
+		}
+		srv.cancelWatches(active)
+		srv.cancelLeases(active)
+		srv.reclaimSandboxes(active)
+		if srv.backend != nil {
+			srv.deleteNamespaces(active)
+		}
 	}
 }
 
-func withCache(h ContextHandler) ContextHandler {
+// withCache registers the user of the request, and passes the user ID
+// in the context. If the route has a rate limit policy, requests over
+// the user's rate limit are rejected before reaching the handler.
+func (srv *Server) withCache(h ContextHandler) ContextHandler {
 	return ContextHandlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
 		userID := generateUserID(req)
-		globalServerVisitsMu.Lock()
-		globalServerVisits.Insert([]byte(fmt.Sprintf("%s%s", userID, time.Now().String()[:13])))
-		globalServerVisitsMu.Unlock()
+		srv.visitsMu.Lock()
+		srv.visits.Insert([]byte(fmt.Sprintf("%s%s", userID, time.Now().String()[:13])))
+		srv.visitsMu.Unlock()
 		ctx = context.WithValue(ctx, userKey, &userID)
 
-		globalUserCacheLock.Lock()
-		if _, ok := globalUserCache[userID]; !ok { // if user visits first time, create user cache
+		srv.userCacheMu.Lock()
+		if _, ok := srv.userCache[userID]; !ok { // if user visits first time, create user cache
 			lg.Infof("just created user %q", userID)
-			globalUserCache[userID] = userData{lastActive: time.Now()}
+			srv.userCache[userID] = userData{lastActive: time.Now()}
+		}
+		srv.userCacheMu.Unlock()
+
+		if pl, ok := srv.routeLimiters[req.URL.Path]; ok {
+			if !srv.checkRateLimit(w, pl, userID, routeRequestName(req.URL.Path)) {
+				return nil
+			}
 		}
-		globalUserCacheLock.Unlock()
 
 		return h.ServeHTTPContext(ctx, w, req)
 	})
@@ -106,24 +141,26 @@ type Connect struct {
 	Deleted bool
 }
 
-func connectHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+func (srv *Server) connectHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
 	user := ctx.Value(userKey).(*string)
 	userID := *user
 
 	switch req.Method {
 	case http.MethodGet:
-		resp := Connect{WebPort: globalWebserverPort, User: userID, Deleted: false}
+		resp := Connect{WebPort: srv.webPort, User: userID, Deleted: false}
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			return err
 		}
 
 	case http.MethodDelete: // user leaves component
 		lg.Infof("user %q just left (user deleted)", userID)
-		globalUserCacheLock.Lock()
-		delete(globalUserCache, userID)
-		globalUserCacheLock.Unlock()
+		srv.userCacheMu.Lock()
+		delete(srv.userCache, userID)
+		srv.userCacheMu.Unlock()
+		srv.cancelWatches(func(id string) bool { return id != userID })
+		srv.cancelLeases(func(id string) bool { return id != userID })
 
-		resp := Connect{WebPort: globalWebserverPort, User: userID, Deleted: true}
+		resp := Connect{WebPort: srv.webPort, User: userID, Deleted: true}
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
 			return err
 		}
@@ -158,54 +195,62 @@ type ServerStatus struct {
 	MemberStatuses []clusterpb.MemberStatus
 }
 
-func getUserIDs() []string {
-	globalUserCacheLock.RLock()
-	s := make([]string, 0, len(globalUserCache))
-	for id := range globalUserCache {
+func (srv *Server) getUserIDs() []string {
+	srv.userCacheMu.RLock()
+	s := make([]string, 0, len(srv.userCache))
+	for id := range srv.userCache {
 		s = append(s, maskUserID(id))
 		if len(s) > 20 {
 			break
 		}
 	}
-	globalUserCacheLock.RUnlock()
+	srv.userCacheMu.RUnlock()
 
 	sort.Strings(s)
 	return s
 }
 
-func getUserIDsN() (n int) {
-	globalUserCacheLock.RLock()
-	n = len(globalUserCache)
-	globalUserCacheLock.RUnlock()
+func (srv *Server) getUserIDsN() (n int) {
+	srv.userCacheMu.RLock()
+	n = len(srv.userCache)
+	srv.userCacheMu.RUnlock()
 	return
 }
 
-func serverStatusHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+// serverStatus returns the server status of the user, marking the user active.
+func (srv *Server) serverStatus(userID string) ServerStatus {
+	srv.userCacheMu.Lock()
+	_, active := srv.userCache[userID]
+	if active {
+		srv.userCache[userID] = userData{lastActive: time.Now()}
+	}
+	srv.userCacheMu.Unlock()
+
+	srv.visitsMu.Lock()
+	vnum := srv.visits.Estimate()
+	srv.visitsMu.Unlock()
+	resp := ServerStatus{
+		PlaygroundActive: active,
+		ServerVisits:     vnum,
+		UserN:            srv.getUserIDsN(),
+		Users:            srv.getUserIDs(),
+	}
+	// sandboxes are created only by client requests
+	if backend, ok := srv.findUserBackend(userID); !ok {
+		resp.PlaygroundActive = false
+	} else {
+		resp.ServerUptime = humanize.Time(backend.Started())
+		resp.MemberStatuses = backend.AllMemberStatus()
+	}
+	return resp
+}
+
+func (srv *Server) serverStatusHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
 	switch req.Method {
 	case http.MethodGet:
-		user := ctx.Value(userKey).(*string)
-		userID := *user
-		globalUserCacheLock.Lock()
-		_, active := globalUserCache[userID]
-		if active {
-			globalUserCache[userID] = userData{lastActive: time.Now()}
-		}
-		globalUserCacheLock.Unlock()
-
-		active = active && globalCluster != nil
-
-		globalServerVisitsMu.Lock()
-		vnum := globalServerVisits.Estimate()
-		globalServerVisitsMu.Unlock()
-		resp := ServerStatus{
-			PlaygroundActive: active,
-			ServerUptime:     humanize.Time(globalCluster.Started),
-			ServerVisits:     vnum,
-			UserN:            getUserIDsN(),
-			Users:            getUserIDs(),
-			MemberStatuses:   globalCluster.AllMemberStatus(),
-		}
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
+		srv.pollStatus()
+		userID := *ctx.Value(userKey).(*string)
+		if err := json.NewEncoder(w).Encode(srv.serverStatus(userID)); err != nil {
 			return err
 		}
 
@@ -220,14 +265,62 @@ func serverStatusHandler(ctx context.Context, w http.ResponseWriter, req *http.R
 type KeyValue struct {
 	Key   string
 	Value string
+
+	// metadata of the key in responses
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+	Lease          string // in hex, empty if none
 }
 
 // ClientRequest defines client requests.
 type ClientRequest struct {
-	Action      string // 'write', 'stress', 'delete', 'get', 'stop-node', 'restart-node'
-	RangePrefix bool   // 'delete', 'get'
+	Action      string // 'write', 'stress', 'delete', 'get', 'watch', 'history', 'txn', 'lease-grant', 'lease-keepalive', 'lease-revoke', 'lease-list', 'stop-node', 'restart-node', 'replace-node'
+	RangePrefix bool   // 'delete', 'get', 'watch', 'history'; with empty key, 'get' gets all keys
+	Member      string // member name or ID; overrides 'Endpoints' to find the target member
 	Endpoints   []string
 	KeyValue    KeyValue
+
+	// Balanced connects 'write', 'stress', 'delete', 'get' and 'txn' to
+	// all 'Endpoints' through the client balancer, instead of the member
+	// of the first endpoint. Requests fail over to the other endpoints
+	// when the serving member stops.
+	Balanced bool
+
+	// RangeEnd is the exclusive end of the range of 'get', 'delete' and 'history',
+	// overriding 'RangePrefix'. "\x00" is all keys from the key.
+	RangeEnd string
+
+	// range options of 'get'
+	Limit      int64
+	SortOrder  string // 'ascend', 'descend'
+	SortTarget string // 'key', 'version', 'create', 'mod', 'value'
+	KeysOnly   bool
+	CountOnly  bool
+	// Revision is the revision to read at, or zero for the latest.
+	Revision int64
+	// Serializable reads from the local state of the member without
+	// consensus, instead of a linearizable read. The result may be
+	// stale, but is served even when the member lost quorum.
+	Serializable bool
+
+	// StartRevision is the revision to start 'watch' and 'history' from.
+	// Zero watches the changes after the request, or the whole history.
+	StartRevision int64
+	// EndRevision is the last revision of 'history', or zero for the latest.
+	EndRevision int64
+
+	// Txn is the transaction of 'txn'.
+	Txn *TxnRequest
+
+	// TTL is the lease TTL in seconds of 'lease-grant', or of 'write'
+	// to attach the key to a new lease.
+	TTL int64
+	// LeaseID is the lease in hex of 'lease-keepalive' and 'lease-revoke',
+	// or of 'write' to attach the key to.
+	LeaseID string
+	// KeepAlive is the number of seconds 'lease-keepalive' keeps the lease alive.
+	KeepAlive int64
 }
 
 // ClientResponse translates client's GET response in frontend-friendly format.
@@ -237,30 +330,64 @@ type ClientResponse struct {
 	Result        string
 	ResultLines   []string
 	KeyValues     []KeyValue
+
+	// Revision, RaftTerm and MemberID (in hex) are of the response
+	// header of the key-value actions, and MemberName and Endpoint are
+	// of the member that served the request. Count is the number of keys
+	// in the range of 'get', and More is true if the range has more keys,
+	// or 'history' has more events, than returned.
+	Revision   int64
+	RaftTerm   uint64
+	MemberID   string
+	MemberName string
+	Endpoint   string
+	Count      int64
+	More       bool
+
+	// Events are the changes of 'history'. CompactRevision is set if
+	// the history before it was compacted, so the events start from it.
+	Events          []WatchEvent
+	CompactRevision int64
+
+	// OperationID is set for 'stop-node', 'restart-node' and 'replace-node',
+	// which are run asynchronously; poll '/operation?id=' for the result.
+	OperationID string
+
+	// WatchID is set for 'watch'; stream '/watch?id=' for the events.
+	WatchID string
+
+	// TxnBranch is 'then' or 'else', the branch that 'txn' ran, and
+	// TxnResponses are the responses of its operations.
+	TxnBranch    string
+	TxnResponses []TxnOpResponse
+
+	// LeaseID is the lease of 'write' and the lease actions, in hex.
+	LeaseID string
+	// Leases are the leases of the user listed by 'lease-list'.
+	Leases []LeaseInfo
 }
 
 var (
 	minScaleToDisplay = time.Millisecond
+
+	// stopRestartTimeout is the timeout for 'stop-node' and 'restart-node'.
+	stopRestartTimeout = 10 * time.Second
+
+	// replaceTimeout is the timeout for 'replace-node', including catch-up.
+	replaceTimeout = 30 * time.Second
+
 	// ErrNoEndpoint is returned when client request has no target endpoint.
 	ErrNoEndpoint = "no endpoint is given"
 )
 
 // clientRequestHandler handles writes, reads, deletes, kill, restart operations.
-func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+func (srv *Server) clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
 	switch req.Method {
 	case http.MethodPost:
 		cresp := ClientResponse{Success: true}
 		defer func() {
 			lg.Info(cresp.Result)
 		}()
-		if rmsg, ok := globalClientRequestLimiter.Check(); !ok {
-			cresp.Success = false
-			cresp.Result = "client request " + rmsg
-			cresp.ResultLines = []string{cresp.Result}
-			return json.NewEncoder(w).Encode(cresp)
-		}
-		globalClientRequestLimiter.Advance()
-
 		creq := ClientRequest{}
 		if err := json.NewDecoder(req.Body).Decode(&creq); err != nil {
 			cresp.Success = false
@@ -276,23 +403,74 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 		if creq.KeyValue.Value != "" {
 			creq.KeyValue.Value = template.HTMLEscapeString(creq.KeyValue.Value)
 		}
+		if creq.RangeEnd != "" && creq.RangeEnd != allKeysFrom {
+			creq.RangeEnd = template.HTMLEscapeString(creq.RangeEnd)
+		}
+		if creq.Txn != nil {
+			creq.Txn.escape()
+		}
 
 		cresp.ClientRequest = creq
 
-		if len(creq.Endpoints) == 0 {
+		userID := *ctx.Value(userKey).(*string)
+		if pl, ok := srv.actionLimiters[creq.Action]; ok {
+			if !srv.checkRateLimit(w, pl, userID, fmt.Sprintf("'%s' request", creq.Action)) {
+				return nil
+			}
+		}
+
+		backend, err := srv.userBackend(req.Context(), userID)
+		if err != nil {
 			cresp.Success = false
-			cresp.Result = ErrNoEndpoint
+			cresp.Result = fmt.Sprintf("cluster is not available (%v)", err)
 			cresp.ResultLines = []string{cresp.Result}
 			return json.NewEncoder(w).Encode(cresp)
 		}
 
-		idx := globalCluster.FindIndex(creq.Endpoints[0])
-		if idx == -1 {
+		switch creq.Action {
+		case "write", "stress", "txn":
+			if srv.cfg.Sandbox && srv.sandboxDiskFull() {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("%q is rejected (%v)", creq.Action, errSandboxDiskFull)
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
+		}
+
+		var (
+			member MemberInfo
+			merr   error
+		)
+		switch {
+		case creq.Member != "":
+			member, merr = backend.Member(creq.Member)
+			if merr != nil {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("wrong member is given (%q, %v)", creq.Member, merr)
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
+			if len(creq.Endpoints) == 0 {
+				creq.Endpoints = member.Endpoints
+				cresp.ClientRequest = creq
+			}
+
+		case len(creq.Endpoints) == 0:
 			cresp.Success = false
-			cresp.Result = fmt.Sprintf("wrong endpoints are given (%v)", creq.Endpoints)
+			cresp.Result = ErrNoEndpoint
 			cresp.ResultLines = []string{cresp.Result}
 			return json.NewEncoder(w).Encode(cresp)
+
+		default:
+			member, merr = backend.FindMember(creq.Endpoints[0])
+			if merr != nil {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("wrong endpoints are given (%v)", creq.Endpoints)
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
 		}
+		name := member.Name
 
 		cctx, ccancel := context.WithTimeout(ctx, 3*time.Second)
 		defer ccancel()
@@ -308,21 +486,39 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 				return json.NewEncoder(w).Encode(cresp)
 			}
 
-			cli, _, err := globalCluster.Client(creq.Endpoints...)
+			cli, err := srv.requestKV(backend, userID, creq)
 			if err != nil {
 				cresp.Success = false
 				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			defer cli.Close()
+
+			var opts []clientv3.OpOption
+			if creq.TTL > 0 || creq.LeaseID != "" {
+				var lid clientv3.LeaseID
+				if creq.LeaseID != "" {
+					lid, err = srv.userLease(backend, userID, creq.LeaseID)
+				} else {
+					lid, err = srv.grantLease(cctx, backend, userID, creq.TTL, creq.Endpoints...)
+				}
+				if err != nil {
+					cresp.Success = false
+					cresp.Result = fmt.Sprintf("'write' request rejected (%v)", err)
+					cresp.ResultLines = []string{cresp.Result}
+					return json.NewEncoder(w).Encode(cresp)
+				}
+				cresp.LeaseID = leaseIDString(lid)
+				opts = append(opts, clientv3.WithLease(lid))
+			}
 
 			cresp.KeyValues = []KeyValue{creq.KeyValue}
-			if _, err := cli.Put(cctx, creq.KeyValue.Key, creq.KeyValue.Value); err != nil {
+			if presp, err := cli.Put(cctx, creq.KeyValue.Key, creq.KeyValue.Value, opts...); err != nil {
 				cresp.Success = false
 				cresp.Result = err.Error()
 				cresp.ResultLines = []string{cresp.Result}
 			} else {
+				cresp.setHeader(backend, presp.Header)
 				cresp.Success = true
 				cresp.Result = fmt.Sprintf("'write' success (took %v)", roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				lines := make([]string, 1)
@@ -336,6 +532,12 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 					}
 					lines[i] = fmt.Sprintf("'write' success (key: %s, value: %s)", ks, vs)
 				}
+				if cresp.LeaseID != "" {
+					lines[0] = fmt.Sprintf("'write' success (key: %s, lease: %s)", cresp.KeyValues[0].Key, cresp.LeaseID)
+				}
+				if creq.Balanced {
+					lines = append(lines, cresp.balancedLine())
+				}
 				cresp.ResultLines = lines
 			}
 			if err := json.NewEncoder(w).Encode(cresp); err != nil {
@@ -343,14 +545,13 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 			}
 
 		case "stress":
-			cli, _, err := globalCluster.Client(creq.Endpoints...)
+			cli, err := srv.requestKV(backend, userID, creq)
 			if err != nil {
 				cresp.Success = false
 				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			defer cli.Close()
 
 			cresp.KeyValues = multiRandKeyValues("foo", "bar", 3, 3)
 			for _, kv := range cresp.KeyValues {
@@ -389,35 +590,42 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 				return json.NewEncoder(w).Encode(cresp)
 			}
 
-			cli, _, err := globalCluster.Client(creq.Endpoints...)
+			cli, err := srv.requestKV(backend, userID, creq)
 			if err != nil {
 				cresp.Success = false
 				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			defer cli.Close()
 
-			var opts []clientv3.OpOption
-			if creq.RangePrefix {
-				opts = append(opts, clientv3.WithPrefix(), clientv3.WithPrevKV())
+			opts, err := creq.rangeOptions()
+			if err != nil {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("'delete' request rejected (%v)", err)
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
+			if len(opts) > 0 {
+				opts = append(opts, clientv3.WithPrevKV())
 			}
 			dresp, err := cli.Delete(cctx, creq.KeyValue.Key, opts...)
 			if err != nil {
 				cresp.Success = false
 				cresp.Result = err.Error()
+				cresp.ResultLines = []string{cresp.Result}
+			} else {
+				cresp.setHeader(backend, dresp.Header)
+				cresp.KeyValues = toKeyValues(dresp.PrevKvs)
 			}
-			kvs := make([]KeyValue, len(dresp.PrevKvs))
-			for i := range dresp.PrevKvs {
-				kvs[i] = KeyValue{Key: string(dresp.PrevKvs[i].Key), Value: string(dresp.PrevKvs[i].Value)}
-			}
-			cresp.KeyValues = kvs
 
 			if cresp.Success {
 				cresp.Result = fmt.Sprintf("'delete' success (took %v)", roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				lines := make([]string, len(cresp.KeyValues))
 				for i := range lines {
-					lines[i] = fmt.Sprintf("'delete' success (key: %s, value: %s)", cresp.KeyValues[i].Key, cresp.KeyValues[i].Value)
+					lines[i] = keyValueLine("delete", cresp.KeyValues[i])
+				}
+				if creq.Balanced {
+					lines = append(lines, cresp.balancedLine())
 				}
 				cresp.ResultLines = lines
 			}
@@ -426,48 +634,60 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 			}
 
 		case "get":
-			if creq.KeyValue.Key == "" {
+			if creq.KeyValue.Key == "" && !creq.RangePrefix && creq.RangeEnd == "" {
 				cresp.Success = false
 				cresp.Result = fmt.Sprint("'get' request got empty key")
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
 
-			// TODO: get all keys and by prefix
+			opts, err := creq.rangeOptions()
+			if err != nil {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("'get' request rejected (%v)", err)
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
 
-			cli, _, err := globalCluster.Client(creq.Endpoints...)
+			cli, err := srv.requestKV(backend, userID, creq)
 			if err != nil {
 				cresp.Success = false
 				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			defer cli.Close()
 
-			var opts []clientv3.OpOption
-			if creq.RangePrefix {
-				opts = append(opts, clientv3.WithPrefix(), clientv3.WithPrevKV())
-			}
-			gresp, err := cli.Get(cctx, creq.KeyValue.Key, opts...)
+			gresp, err := cli.Get(cctx, creq.rangeKey(), opts...)
 			if err != nil {
 				cresp.Success = false
 				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
+			} else {
+				cresp.setHeader(backend, gresp.Header)
+				cresp.KeyValues = toKeyValues(gresp.Kvs)
+				cresp.Count, cresp.More = gresp.Count, gresp.More
 			}
-			kvs := make([]KeyValue, len(gresp.Kvs))
-			for i := range gresp.Kvs {
-				kvs[i] = KeyValue{Key: string(gresp.Kvs[i].Key), Value: string(gresp.Kvs[i].Value)}
-			}
-			cresp.KeyValues = kvs
 
 			if err == nil {
-				cresp.Result = fmt.Sprintf("'get' success (took %v)", roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				mode := "linearizable"
+				if creq.Serializable {
+					mode = "serializable"
+				}
+				cresp.Result = fmt.Sprintf("'get' success (%s read from %s, revision %d, raft term %d, took %v)", mode, cresp.MemberName, cresp.Revision, cresp.RaftTerm, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				lines := make([]string, len(cresp.KeyValues))
 				for i := range lines {
-					lines[i] = fmt.Sprintf("'get' success (key: %s, value: %s)", cresp.KeyValues[i].Key, cresp.KeyValues[i].Value)
+					lines[i] = keyValueLine("get", cresp.KeyValues[i])
 				}
-				if len(lines) == 0 {
+				switch {
+				case creq.CountOnly:
+					lines = append(lines, fmt.Sprintf("'get' success (%d keys in range)", cresp.Count))
+				case len(lines) == 0:
 					lines = append(lines, fmt.Sprintf("key %q does not exist", creq.KeyValue.Key))
+				case cresp.More:
+					lines = append(lines, fmt.Sprintf("'get' success (%d of %d keys in range)", len(lines), cresp.Count))
+				}
+				if creq.Balanced {
+					lines = append(lines, cresp.balancedLine())
 				}
 				cresp.ResultLines = lines
 			}
@@ -476,67 +696,196 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 				return err
 			}
 
-		case "stop-node":
-			if rmsg, ok := globalStopRestartLimiter.Check(); !ok {
+		case "watch":
+			if creq.KeyValue.Key == "" {
 				cresp.Success = false
-				cresp.Result = "'stop-node' request " + rmsg
+				cresp.Result = fmt.Sprint("'watch' request got empty key")
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			globalStopRestartLimiter.Advance()
 
-			if globalCluster.ActiveNodeN() < globalCluster.Quorum() {
+			id, err := srv.startWatch(backend, userID, creq)
+			if err != nil {
 				cresp.Success = false
-				cresp.Result = "'stop-node' request rejected (already quorum lost!)"
+				cresp.Result = fmt.Sprintf("'watch' request rejected (%v)", err)
+			} else {
+				cresp.WatchID = id
+				what := fmt.Sprintf("key %q", creq.KeyValue.Key)
+				if creq.RangePrefix {
+					what = fmt.Sprintf("prefix %q", creq.KeyValue.Key)
+				}
+				cresp.Result = fmt.Sprintf("'watch' started on %s (watch %s)", what, id)
+			}
+			cresp.ResultLines = []string{cresp.Result}
+			if err := json.NewEncoder(w).Encode(cresp); err != nil {
+				return err
+			}
+
+		case "history":
+			if creq.KeyValue.Key == "" && !creq.RangePrefix && creq.RangeEnd == "" {
+				cresp.Success = false
+				cresp.Result = fmt.Sprint("'history' request got empty key")
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
 
-			lg.Infof("starting 'stop-node' on %q(%s)", globalCluster.MemberStatus(idx).Name, globalCluster.MemberStatus(idx).ID)
-			if globalCluster.IsStopped(idx) {
+			if err := srv.keyHistory(cctx, backend, userID, &cresp); err != nil {
 				cresp.Success = false
-				cresp.Result = fmt.Sprintf("%s is already stopped (took %v)", globalCluster.MemberStatus(idx).Name, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			globalCluster.Stop(idx)
-			lg.Infof("finished 'stop-node' on %q(%s)", globalCluster.MemberStatus(idx).Name, globalCluster.MemberStatus(idx).ID)
 
-			cresp.Result = fmt.Sprintf("stopped %s (took %v)", globalCluster.MemberStatus(idx).Name, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
-			cresp.ResultLines = []string{cresp.Result}
+			cresp.Result = fmt.Sprintf("'history' success (%d events, took %v)", len(cresp.Events), roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+			lines := []string{cresp.Result}
+			if cresp.CompactRevision > creq.StartRevision {
+				lines = append(lines, fmt.Sprintf("history before revision %d was compacted", cresp.CompactRevision))
+			}
+			for _, ev := range cresp.Events {
+				lines = append(lines, "'history' "+ev.Message)
+			}
+			if cresp.More {
+				lines = append(lines, fmt.Sprintf("'history' has more events (showing first %d)", len(cresp.Events)))
+			}
+			cresp.ResultLines = lines
 			if err := json.NewEncoder(w).Encode(cresp); err != nil {
 				return err
 			}
 
-		case "restart-node":
-			if rmsg, ok := globalStopRestartLimiter.Check(); !ok {
+		case "txn":
+			if creq.Txn == nil {
 				cresp.Success = false
-				cresp.Result = "'restart-node' request " + rmsg
+				cresp.Result = fmt.Sprint("'txn' request got empty transaction")
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
+			cmps, err := creq.Txn.toCmps()
+			var thenOps, elseOps []clientv3.Op
+			if err == nil {
+				thenOps, err = toTxnOps("then", creq.Txn.Then)
+			}
+			if err == nil {
+				elseOps, err = toTxnOps("else", creq.Txn.Else)
+			}
+			if err != nil {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("'txn' request rejected (%v)", err)
 				cresp.ResultLines = []string{cresp.Result}
 				return json.NewEncoder(w).Encode(cresp)
 			}
-			globalStopRestartLimiter.Advance()
 
-			lg.Infof("starting 'restart-node' on %q(%s)", globalCluster.MemberStatus(idx).Name, globalCluster.MemberStatus(idx).ID)
-			if !globalCluster.IsStopped(idx) {
+			cli, err := srv.requestKV(backend, userID, creq)
+			if err != nil {
 				cresp.Success = false
-				cresp.Result = fmt.Sprintf("%s is already started (took %v)", globalCluster.MemberStatus(idx).Name, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
 				cresp.ResultLines = []string{cresp.Result}
-				lg.Warnf("'restart-node' %s", cresp.Result)
 				return json.NewEncoder(w).Encode(cresp)
 			}
 
-			if rerr := globalCluster.Restart(idx); rerr != nil {
-				lg.Warnf("'restart-node' error %v", rerr)
+			tresp, err := cli.Txn(cctx).If(cmps...).Then(thenOps...).Else(elseOps...).Commit()
+			if err != nil {
 				cresp.Success = false
-				cresp.Result = rerr.Error()
-			} else {
-				cresp.Success = true
-				cresp.Result = fmt.Sprintf("restarted %s (took %v)", globalCluster.MemberStatus(idx).Name, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				cresp.Result = fmt.Sprintf("client error %v (took %v)", err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
 			}
-			lg.Infof("finished 'restart-node' on %q(%s)", globalCluster.MemberStatus(idx).Name, globalCluster.MemberStatus(idx).ID)
 
-			cresp.ResultLines = []string{cresp.Result}
+			branch, branchOps := "then", creq.Txn.Then
+			if !tresp.Succeeded {
+				branch, branchOps = "else", creq.Txn.Else
+			}
+			cresp.TxnBranch = branch
+			cresp.setHeader(backend, tresp.Header)
+			cresp.TxnResponses = txnOpResponses(branchOps, tresp.Responses)
+			cresp.Result = fmt.Sprintf("'txn' success, ran '%s' (revision %d, took %v)", cresp.TxnBranch, tresp.Header.Revision, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+			lines := []string{cresp.Result}
+			for _, r := range cresp.TxnResponses {
+				lines = append(lines, fmt.Sprintf("'txn' %s %s", cresp.TxnBranch, txnOpResponseLine(r)))
+			}
+			if creq.Balanced {
+				lines = append(lines, cresp.balancedLine())
+			}
+			cresp.ResultLines = lines
+			if err := json.NewEncoder(w).Encode(cresp); err != nil {
+				return err
+			}
+
+		case "lease-grant", "lease-keepalive", "lease-revoke", "lease-list":
+			srv.leaseRequest(cctx, backend, userID, &cresp)
+			if err := json.NewEncoder(w).Encode(cresp); err != nil {
+				return err
+			}
+
+		case "stop-node":
+			if backend.ActiveNodeN() < backend.Quorum() {
+				cresp.Success = false
+				cresp.Result = "'stop-node' request rejected (already quorum lost!)"
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
+
+			if member.Stopped {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("%s is already stopped (took %v)", name, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				cresp.ResultLines = []string{cresp.Result}
+				return json.NewEncoder(w).Encode(cresp)
+			}
+			srv.submitOperation(&cresp, backend, userID, name, func(ctx context.Context) (string, error) {
+				lg.Infof("starting 'stop-node' on %q", name)
+				defer lg.Infof("finished 'stop-node' on %q", name)
+
+				now := time.Now()
+				sctx, scancel := context.WithTimeout(ctx, stopRestartTimeout)
+				defer scancel()
+				if err := backend.Stop(sctx, name); err != nil {
+					return "", fmt.Errorf("failed to stop %s (%v, took %v)", name, err, roundDownDuration(time.Since(now), minScaleToDisplay))
+				}
+				return fmt.Sprintf("stopped %s (took %v)", name, roundDownDuration(time.Since(now), minScaleToDisplay)), nil
+			})
+			if err := json.NewEncoder(w).Encode(cresp); err != nil {
+				return err
+			}
+
+		case "restart-node":
+			if !member.Stopped {
+				cresp.Success = false
+				cresp.Result = fmt.Sprintf("%s is already started (took %v)", name, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+				cresp.ResultLines = []string{cresp.Result}
+				lg.Warnf("'restart-node' %s", cresp.Result)
+				return json.NewEncoder(w).Encode(cresp)
+			}
+
+			srv.submitOperation(&cresp, backend, userID, name, func(ctx context.Context) (string, error) {
+				lg.Infof("starting 'restart-node' on %q", name)
+				defer lg.Infof("finished 'restart-node' on %q", name)
+
+				now := time.Now()
+				rctx, rcancel := context.WithTimeout(ctx, stopRestartTimeout)
+				defer rcancel()
+				if err := backend.Restart(rctx, name); err != nil {
+					return "", fmt.Errorf("failed to restart %s (%v, took %v)", name, err, roundDownDuration(time.Since(now), minScaleToDisplay))
+				}
+				return fmt.Sprintf("restarted %s (took %v)", name, roundDownDuration(time.Since(now), minScaleToDisplay)), nil
+			})
+			if err := json.NewEncoder(w).Encode(cresp); err != nil {
+				return err
+			}
+
+		case "replace-node":
+			srv.submitOperation(&cresp, backend, userID, name, func(ctx context.Context) (string, error) {
+				lg.Infof("starting 'replace-node' on %q", name)
+				defer lg.Infof("finished 'replace-node' on %q", name)
+
+				now := time.Now()
+				oldID := member.ID
+				rctx, rcancel := context.WithTimeout(ctx, replaceTimeout)
+				defer rcancel()
+				nm, err := backend.Replace(rctx, name)
+				if err != nil {
+					return "", fmt.Errorf("failed to replace %s (%v, took %v)", name, err, roundDownDuration(time.Since(now), minScaleToDisplay))
+				}
+				return fmt.Sprintf("replaced %s (old ID %s, new ID %s, took %v)", name, oldID, nm.ID, roundDownDuration(time.Since(now), minScaleToDisplay)), nil
+			})
 			if err := json.NewEncoder(w).Encode(cresp); err != nil {
 				return err
 			}
@@ -551,3 +900,19 @@ func clientRequestHandler(ctx context.Context, w http.ResponseWriter, req *http.
 
 	return nil
 }
+
+// submitOperation submits the cluster operation of the user's request,
+// and sets the operation ID or the submit error to the response.
+func (srv *Server) submitOperation(cresp *ClientResponse, backend Backend, userID, name string, f func(context.Context) (string, error)) {
+	act := cresp.ClientRequest.Action
+	op, err := srv.operations.submit(backend, userID, act, name, f)
+	if err != nil {
+		cresp.Success = false
+		cresp.Result = fmt.Sprintf("'%s' request rejected (%v)", act, err)
+	} else {
+		cresp.Success = true
+		cresp.OperationID = op.ID
+		cresp.Result = fmt.Sprintf("submitted '%s' on %s (operation %s)", act, name, op.ID)
+	}
+	cresp.ResultLines = []string{cresp.Result}
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+var (
+	// maxHistoryEvents is the maximum number of events of 'history'.
+	maxHistoryEvents = 1000
+
+	// historyWaitTimeout bounds the wait for the events of a window whose
+	// keys were not modified at its end revision, which may have no events.
+	historyWaitTimeout = time.Second
+)
+
+// keyHistory sets the changes of the key or range of the request in the
+// revision window to the response, by replaying a watch from the start
+// revision. If the start revision has been compacted, the history starts
+// from the compact revision instead, which is set to the response.
+//
+// The replay ends at the first event after the window, or at the last
+// modification of the range at the end revision. The server sends the
+// history of a new watch up to its current revision at once, so the
+// deletions after that modification come in the same response.
+func (srv *Server) keyHistory(ctx context.Context, backend Backend, userID string, cresp *ClientResponse) error {
+	creq := &cresp.ClientRequest
+	opts, err := creq.rangeOptions()
+	if err != nil {
+		return err
+	}
+
+	kv, err := srv.userKV(backend, userID, creq.Endpoints...)
+	if err != nil {
+		return err
+	}
+	gresp, err := kv.Get(ctx, creq.rangeKey(), append(opts, clientv3.WithCountOnly())...)
+	if err != nil {
+		return err
+	}
+	cresp.setHeader(backend, gresp.Header)
+
+	start, end := creq.StartRevision, creq.EndRevision
+	if start <= 0 {
+		start = 1
+	}
+	if end <= 0 || end > gresp.Header.Revision {
+		end = gresp.Header.Revision
+	}
+	if start > end {
+		return fmt.Errorf("start revision %d is after end revision %d", start, end)
+	}
+
+	// the last modification of the range in the window
+	var lastRev int64
+	lresp, err := kv.Get(ctx, creq.rangeKey(), append(opts, clientv3.WithRev(end), clientv3.WithKeysOnly(), clientv3.WithLimit(1), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortDescend))...)
+	switch {
+	case err == nil:
+		if len(lresp.Kvs) > 0 {
+			lastRev = lresp.Kvs[0].ModRevision
+		}
+	case err != rpctypes.ErrCompacted:
+		// the watch reports the compaction
+		return err
+	}
+
+	w, err := srv.userWatcher(backend, userID, creq.Endpoints...)
+	if err != nil {
+		return err
+	}
+	var (
+		wctx    context.Context
+		wcancel = func() {}
+		wch     clientv3.WatchChan
+	)
+	defer func() { wcancel() }()
+	watch := func(rev int64) {
+		wcancel()
+		wctx, wcancel = context.WithCancel(clientv3.WithRequireLeader(ctx))
+		wch = w.Watch(wctx, creq.rangeKey(), append(opts, clientv3.WithPrevKV(), clientv3.WithRev(rev))...)
+	}
+	watch(start)
+
+	// without modifications at the end revision, the window may have no
+	// events to wait for
+	var waitc <-chan time.Time
+	if lastRev < start {
+		waitc = time.After(historyWaitTimeout)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-waitc:
+			return nil
+
+		case wr, ok := <-wch:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return errors.New("watch closed before replaying the history")
+			}
+			if wr.CompactRevision != 0 {
+				cresp.CompactRevision = wr.CompactRevision
+				if wr.CompactRevision > end {
+					return nil
+				}
+				watch(wr.CompactRevision)
+				continue
+			}
+			if err = wr.Err(); err != nil {
+				return err
+			}
+			for _, ev := range wr.Events {
+				if ev.Kv.ModRevision > end {
+					return nil
+				}
+				if len(cresp.Events) == maxHistoryEvents {
+					cresp.More = true
+					return nil
+				}
+				cresp.Events = append(cresp.Events, toWatchEvent(ev))
+			}
+			if n := len(wr.Events); n > 0 && wr.Events[n-1].Kv.ModRevision >= lastRev {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+var (
+	// maxUserLeases is the number of leases a user can hold.
+	maxUserLeases = 10
+
+	// maxLeaseTTL is the maximum TTL of a lease, so that the keys of
+	// users who left do not live long on the shared cluster.
+	maxLeaseTTL = int64(time.Hour / time.Second)
+
+	// defaultLeaseKeepAlive and maxLeaseKeepAlive bound how long
+	// 'lease-keepalive' keeps a lease alive.
+	defaultLeaseKeepAlive = 10 * time.Second
+	maxLeaseKeepAlive     = 5 * time.Minute
+
+	errTooManyLeases = errors.New("too many leases are held; revoke one first")
+)
+
+// LeaseInfo describes a lease of the user, listed by 'lease-list'.
+type LeaseInfo struct {
+	ID string // in hex
+
+	// TTL is the remaining TTL in seconds, or -1 if expired.
+	TTL        int64
+	GrantedTTL int64
+	Keys       []string
+
+	// KeepAlive is true while 'lease-keepalive' keeps the lease alive.
+	KeepAlive bool
+}
+
+// leaseKey identifies a lease, since the clusters of users may grant
+// the same lease IDs.
+type leaseKey struct {
+	backend Backend
+	id      clientv3.LeaseID
+}
+
+// userLease is a lease granted by a user.
+type userLease struct {
+	userID string
+	// expires is when the lease expires unless renewed,
+	// updated on every renewal
+	expires time.Time
+
+	// keepAliveCtx is the context of the running 'lease-keepalive',
+	// canceled by stopKeepAlive.
+	keepAliveCtx  context.Context
+	stopKeepAlive func()
+}
+
+// expired returns true if the lease is not kept alive, and has expired.
+func (l *userLease) expired(now time.Time) bool {
+	return l.stopKeepAlive == nil && now.After(l.expires)
+}
+
+// leaseRequest runs the lease actions of the request, and sets the result
+// to the response.
+func (srv *Server) leaseRequest(ctx context.Context, backend Backend, userID string, cresp *ClientResponse) {
+	creq := cresp.ClientRequest
+	reqStart := time.Now()
+
+	var err error
+	switch creq.Action {
+	case "lease-grant":
+		var id clientv3.LeaseID
+		if id, err = srv.grantLease(ctx, backend, userID, creq.TTL, creq.Endpoints...); err == nil {
+			cresp.LeaseID = leaseIDString(id)
+			cresp.Result = fmt.Sprintf("'lease-grant' success (lease %s, TTL %ds, took %v)", cresp.LeaseID, creq.TTL, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+		}
+
+	case "lease-keepalive":
+		var id clientv3.LeaseID
+		if id, err = srv.userLease(backend, userID, creq.LeaseID); err == nil {
+			d := time.Duration(creq.KeepAlive) * time.Second
+			switch {
+			case d <= 0:
+				d = defaultLeaseKeepAlive
+			case d > maxLeaseKeepAlive:
+				d = maxLeaseKeepAlive
+			}
+			srv.keepAliveLease(backend, id, d, creq.Endpoints...)
+			cresp.LeaseID = leaseIDString(id)
+			cresp.Result = fmt.Sprintf("'lease-keepalive' started (lease %s, for %v)", cresp.LeaseID, d)
+		}
+
+	case "lease-revoke":
+		var id clientv3.LeaseID
+		if id, err = srv.userLease(backend, userID, creq.LeaseID); err == nil {
+			if err = srv.revokeLease(ctx, backend, id, creq.Endpoints...); err == nil {
+				cresp.LeaseID = leaseIDString(id)
+				cresp.Result = fmt.Sprintf("'lease-revoke' success (lease %s, took %v)", cresp.LeaseID, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+			}
+		}
+
+	case "lease-list":
+		if cresp.Leases, err = srv.listLeases(ctx, backend, userID, creq.Endpoints...); err == nil {
+			cresp.Result = fmt.Sprintf("'lease-list' success (%d leases, took %v)", len(cresp.Leases), roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+		}
+	}
+
+	if err != nil {
+		cresp.Success = false
+		cresp.Result = fmt.Sprintf("'%s' failed (%v, took %v)", creq.Action, err, roundDownDuration(time.Since(reqStart), minScaleToDisplay))
+		cresp.ResultLines = []string{cresp.Result}
+		return
+	}
+	cresp.ResultLines = []string{cresp.Result}
+	for _, l := range cresp.Leases {
+		line := fmt.Sprintf("lease %s (TTL %ds of %ds, keys %v)", l.ID, l.TTL, l.GrantedTTL, l.Keys)
+		if l.TTL < 0 {
+			line = fmt.Sprintf("lease %s expired", l.ID)
+		} else if l.KeepAlive {
+			line += " kept alive"
+		}
+		cresp.ResultLines = append(cresp.ResultLines, line)
+	}
+}
+
+// grantLease grants a new lease to the user.
+func (srv *Server) grantLease(ctx context.Context, backend Backend, userID string, ttl int64, eps ...string) (clientv3.LeaseID, error) {
+	if ttl <= 0 || ttl > maxLeaseTTL {
+		return 0, fmt.Errorf("TTL must be between 1 and %d seconds", maxLeaseTTL)
+	}
+
+	// reserve the lease before granting it, so that concurrent
+	// grants cannot exceed the limit, which expired leases do not count to
+	srv.leaseMu.Lock()
+	n := srv.leaseGrants[userID]
+	now := time.Now()
+	for _, l := range srv.leases {
+		if l.userID == userID && !l.expired(now) {
+			n++
+		}
+	}
+	if n >= maxUserLeases {
+		srv.leaseMu.Unlock()
+		return 0, errTooManyLeases
+	}
+	srv.leaseGrants[userID]++
+	srv.leaseMu.Unlock()
+
+	var resp *clientv3.LeaseGrantResponse
+	lc, err := backend.Lease(eps...)
+	if err == nil {
+		resp, err = lc.Grant(ctx, ttl)
+	}
+
+	srv.leaseMu.Lock()
+	defer srv.leaseMu.Unlock()
+	if srv.leaseGrants[userID]--; srv.leaseGrants[userID] == 0 {
+		delete(srv.leaseGrants, userID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	srv.leases[leaseKey{backend, resp.ID}] = &userLease{
+		userID:  userID,
+		expires: time.Now().Add(time.Duration(resp.TTL) * time.Second),
+	}
+	return resp.ID, nil
+}
+
+// userLease returns the lease of the cluster by its ID in hex, if granted by the user.
+func (srv *Server) userLease(backend Backend, userID, idHex string) (clientv3.LeaseID, error) {
+	n, err := strconv.ParseInt(idHex, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("wrong lease ID %q", idHex)
+	}
+	id := clientv3.LeaseID(n)
+
+	srv.leaseMu.Lock()
+	defer srv.leaseMu.Unlock()
+	if l, ok := srv.leases[leaseKey{backend, id}]; !ok || l.userID != userID {
+		return 0, fmt.Errorf("lease %q not found", idHex)
+	}
+	return id, nil
+}
+
+// keepAliveLease renews the lease for the duration, replacing the running
+// keep-alive of the lease. Each renewal goes through the running endpoints,
+// or any running member, so that it continues when a member stops.
+func (srv *Server) keepAliveLease(backend Backend, id clientv3.LeaseID, d time.Duration, eps ...string) {
+	ctx, cancel := context.WithTimeout(srv.rootCtx, d)
+
+	srv.leaseMu.Lock()
+	l, ok := srv.leases[leaseKey{backend, id}]
+	if !ok {
+		srv.leaseMu.Unlock()
+		cancel()
+		return
+	}
+	if l.stopKeepAlive != nil {
+		l.stopKeepAlive()
+	}
+	l.keepAliveCtx, l.stopKeepAlive = ctx, cancel
+	srv.leaseMu.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			srv.leaseMu.Lock()
+			if l.keepAliveCtx == ctx {
+				l.keepAliveCtx, l.stopKeepAlive = nil, nil
+			}
+			srv.leaseMu.Unlock()
+		}()
+
+		interval := 500 * time.Millisecond
+		for {
+			lc, err := backend.Lease(runningEndpoints(backend, eps)...)
+			if err == nil {
+				var resp *clientv3.LeaseKeepAliveResponse
+				rctx, rcancel := context.WithTimeout(ctx, 3*time.Second)
+				resp, err = lc.KeepAliveOnce(rctx, id)
+				rcancel()
+				switch {
+				case err == rpctypes.ErrLeaseNotFound:
+					lg.Infof("stopped keep-alive of expired lease %s", leaseIDString(id))
+					srv.forgetLease(backend, id)
+					return
+				case err == nil && resp.TTL > 0:
+					srv.leaseMu.Lock()
+					l.expires = time.Now().Add(time.Duration(resp.TTL) * time.Second)
+					srv.leaseMu.Unlock()
+
+					// renew well before the lease expires
+					interval = time.Duration(resp.TTL) * time.Second / 3
+				}
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					lg.Warnf("failed to renew lease %s (%v)", leaseIDString(id), err)
+				}
+				interval = 500 * time.Millisecond
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// revokeLease revokes the lease, deleting its keys.
+func (srv *Server) revokeLease(ctx context.Context, backend Backend, id clientv3.LeaseID, eps ...string) error {
+	lc, err := backend.Lease(eps...)
+	if err != nil {
+		return err
+	}
+	if _, err = lc.Revoke(ctx, id); err != nil && err != rpctypes.ErrLeaseNotFound {
+		return err
+	}
+	srv.forgetLease(backend, id)
+	return nil
+}
+
+func (srv *Server) forgetLease(backend Backend, id clientv3.LeaseID) {
+	srv.leaseMu.Lock()
+	defer srv.leaseMu.Unlock()
+	key := leaseKey{backend, id}
+	if l, ok := srv.leases[key]; ok {
+		if l.stopKeepAlive != nil {
+			l.stopKeepAlive()
+		}
+		delete(srv.leases, key)
+	}
+}
+
+// listLeases returns the leases of the user with their remaining TTLs and
+// attached keys. Expired leases are listed once, and then forgotten.
+func (srv *Server) listLeases(ctx context.Context, backend Backend, userID string, eps ...string) ([]LeaseInfo, error) {
+	srv.leaseMu.Lock()
+	ids := make(map[clientv3.LeaseID]bool)
+	for key, l := range srv.leases {
+		if key.backend == backend && l.userID == userID {
+			ids[key.id] = l.stopKeepAlive != nil
+		}
+	}
+	srv.leaseMu.Unlock()
+
+	lc, err := srv.userLeaseClient(backend, userID, eps...)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]LeaseInfo, 0, len(ids))
+	for id, keepAlive := range ids {
+		resp, err := lc.TimeToLive(ctx, id, clientv3.WithAttachedKeys())
+		if err != nil {
+			return nil, err
+		}
+		info := LeaseInfo{ID: leaseIDString(id), TTL: resp.TTL, GrantedTTL: resp.GrantedTTL, KeepAlive: keepAlive}
+		for _, k := range resp.Keys {
+			info.Keys = append(info.Keys, string(k))
+		}
+		if resp.TTL < 0 {
+			srv.forgetLease(backend, id)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// cancelLeases stops the keep-alives and forgets the leases of the users
+// for whom keep returns false, and forgets the expired leases. The leases
+// expire by themselves.
+func (srv *Server) cancelLeases(keep func(userID string) bool) {
+	srv.leaseMu.Lock()
+	defer srv.leaseMu.Unlock()
+	now := time.Now()
+	for key, l := range srv.leases {
+		if !keep(l.userID) || l.expired(now) {
+			if l.stopKeepAlive != nil {
+				l.stopKeepAlive()
+			}
+			delete(srv.leases, key)
+		}
+	}
+}
+
+func leaseIDString(id clientv3.LeaseID) string {
+	return fmt.Sprintf("%016x", int64(id))
+}
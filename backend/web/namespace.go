@@ -0,0 +1,126 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+)
+
+// userNamespace returns the key prefix of the user.
+func userNamespace(userID string) string {
+	sum := sha512.Sum512([]byte(userID))
+	return fmt.Sprintf("/etcdlabs/users/%x/", sum[:8])
+}
+
+// namespaceDeleteTimeout is the timeout to delete the keys of an expired user.
+var namespaceDeleteTimeout = 5 * time.Second
+
+// userKV returns the key-value client of the user. With Namespace,
+// it is scoped to the user's keys on the shared cluster.
+func (srv *Server) userKV(backend Backend, userID string, eps ...string) (clientv3.KV, error) {
+	kv, err := backend.KV(eps...)
+	if err != nil {
+		return nil, err
+	}
+	return srv.scopeKV(userID, kv), nil
+}
+
+// requestKV returns the key-value client of the user for the request,
+// scoped like userKV. With 'Balanced', it connects to all endpoints of
+// the request through the client balancer.
+func (srv *Server) requestKV(backend Backend, userID string, creq ClientRequest) (clientv3.KV, error) {
+	if !creq.Balanced {
+		return srv.userKV(backend, userID, creq.Endpoints...)
+	}
+	kv, err := backend.BalancedKV(creq.Endpoints...)
+	if err != nil {
+		return nil, err
+	}
+	return srv.scopeKV(userID, kv), nil
+}
+
+func (srv *Server) scopeKV(userID string, kv clientv3.KV) clientv3.KV {
+	if !srv.cfg.Namespace || srv.cfg.Sandbox {
+		return kv
+	}
+	srv.namespaceMu.Lock()
+	srv.namespaceUsers[userID] = struct{}{}
+	srv.namespaceMu.Unlock()
+	return namespace.NewKV(kv, userNamespace(userID))
+}
+
+// userLeaseClient returns the lease client of the user, scoped like
+// userKV, so that the attached keys exclude the other users' keys.
+func (srv *Server) userLeaseClient(backend Backend, userID string, eps ...string) (clientv3.Lease, error) {
+	lc, err := backend.Lease(eps...)
+	if err != nil || !srv.cfg.Namespace || srv.cfg.Sandbox {
+		return lc, err
+	}
+	return namespace.NewLease(lc, userNamespace(userID)), nil
+}
+
+// userWatcher returns the watch client of the user, scoped like userKV.
+func (srv *Server) userWatcher(backend Backend, userID string, eps ...string) (clientv3.Watcher, error) {
+	w, err := backend.Watcher(eps...)
+	if err != nil || !srv.cfg.Namespace || srv.cfg.Sandbox {
+		return w, err
+	}
+	return namespace.NewWatcher(w, userNamespace(userID)), nil
+}
+
+// deleteNamespaces deletes the keys of the users for whom keep returns false.
+// The users stay in 'namespaceUsers' until their keys are deleted, so that
+// failed deletes are retried in the next call.
+func (srv *Server) deleteNamespaces(keep func(userID string) bool) {
+	srv.namespaceMu.Lock()
+	var ids []string
+	for userID := range srv.namespaceUsers {
+		if !keep(userID) {
+			ids = append(ids, userID)
+		}
+	}
+	srv.namespaceMu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	kv, err := srv.backend.KV()
+	if err != nil {
+		lg.Warnf("failed to delete keys of %d users (%v)", len(ids), err)
+		return
+	}
+	for _, userID := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), namespaceDeleteTimeout)
+		resp, err := kv.Delete(ctx, userNamespace(userID), clientv3.WithPrefix())
+		cancel()
+		if err != nil {
+			lg.Warnf("failed to delete keys of user %q (%v)", userID, err)
+			continue
+		}
+		lg.Infof("deleted %d keys of user %q", resp.Deleted, userID)
+
+		srv.namespaceMu.Lock()
+		if !keep(userID) { // unless the user came back during the delete
+			delete(srv.namespaceUsers, userID)
+		}
+		srv.namespaceMu.Unlock()
+	}
+}
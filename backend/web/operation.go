@@ -0,0 +1,273 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OperationState is the state of an asynchronous cluster operation.
+type OperationState string
+
+const (
+	// OperationQueued is waiting for earlier operations to finish.
+	OperationQueued OperationState = "queued"
+	// OperationRunning is being run.
+	OperationRunning OperationState = "running"
+	// OperationDone has finished successfully.
+	OperationDone OperationState = "done"
+	// OperationFailed has finished with an error.
+	OperationFailed OperationState = "failed"
+)
+
+// Operation is an asynchronous cluster operation, such as 'stop-node'.
+// Encode without json tags to make it parsable by Typescript.
+type Operation struct {
+	ID     string
+	Action string
+	Member string
+	State  OperationState
+
+	// Result is set when the operation is done or failed.
+	Result string
+	// Error is set when the operation failed.
+	Error string
+
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+}
+
+var (
+	// maxQueuedOperations is the number of operations that can wait to run
+	// on a cluster.
+	maxQueuedOperations = 16
+
+	// maxUserOperations is the number of operations a user can have
+	// queued or running.
+	maxUserOperations = 4
+
+	// maxOperations is the number of operations to keep for polling,
+	// including finished ones.
+	maxOperations = 256
+
+	// operationWaitTimeout is the maximum duration of '/operation' long polling.
+	operationWaitTimeout = 30 * time.Second
+
+	errTooManyOperations     = errors.New("too many operations are queued")
+	errTooManyUserOperations = errors.New("too many operations of the user are queued")
+)
+
+type operationEntry struct {
+	op     Operation
+	userID string
+	run    func(context.Context) (string, error)
+
+	// changec is closed and replaced on every state change
+	changec chan struct{}
+}
+
+// operationQueue runs submitted operations one at a time per cluster,
+// since the operations of a cluster are serialized anyway.
+type operationQueue struct {
+	ctx context.Context
+
+	mu  sync.Mutex
+	seq int
+	ops map[string]*operationEntry
+	ids []string // in submission order, to expire old operations
+
+	// lanes are the unfinished operations of each cluster, the first
+	// one running, and userOps are the numbers of them by user
+	lanes   map[Backend][]*operationEntry
+	userOps map[string]int
+}
+
+// newOperationQueue returns the queue that runs operations until the
+// context is done.
+func newOperationQueue(ctx context.Context) *operationQueue {
+	return &operationQueue{
+		ctx:     ctx,
+		ops:     make(map[string]*operationEntry),
+		lanes:   make(map[Backend][]*operationEntry),
+		userOps: make(map[string]int),
+	}
+}
+
+// run runs the queued operations of the cluster until none are left.
+func (q *operationQueue) run(b Backend) {
+	for {
+		q.mu.Lock()
+		e := q.lanes[b][0]
+		q.mu.Unlock()
+
+		q.update(e, func(op *Operation) {
+			op.State = OperationRunning
+			op.Started = time.Now()
+		})
+		result, err := e.run(q.ctx)
+		q.update(e, func(op *Operation) {
+			op.State = OperationDone
+			op.Result = result
+			if err != nil {
+				op.State = OperationFailed
+				op.Result = err.Error()
+				op.Error = err.Error()
+			}
+			op.Finished = time.Now()
+		})
+
+		q.mu.Lock()
+		q.lanes[b] = q.lanes[b][1:]
+		left := len(q.lanes[b])
+		if left == 0 {
+			delete(q.lanes, b)
+		}
+		if q.userOps[e.userID]--; q.userOps[e.userID] == 0 {
+			delete(q.userOps, e.userID)
+		}
+		q.mu.Unlock()
+		if left == 0 {
+			return
+		}
+	}
+}
+
+// submit queues the operation of the user on the cluster, and returns
+// it in 'queued' state.
+func (q *operationQueue) submit(b Backend, userID, action, member string, f func(context.Context) (string, error)) (Operation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.userOps[userID] >= maxUserOperations {
+		return Operation{}, errTooManyUserOperations
+	}
+	lane := q.lanes[b]
+	if len(lane) > maxQueuedOperations { // excluding the running one
+		return Operation{}, errTooManyOperations
+	}
+
+	q.seq++
+	e := &operationEntry{
+		op: Operation{
+			ID:        fmt.Sprintf("%d-%s", q.seq, randBytes(8)),
+			Action:    action,
+			Member:    member,
+			State:     OperationQueued,
+			Submitted: time.Now(),
+		},
+		userID:  userID,
+		run:     f,
+		changec: make(chan struct{}),
+	}
+	q.lanes[b] = append(lane, e)
+	q.userOps[userID]++
+	if len(lane) == 0 {
+		go q.run(b)
+	}
+	q.ops[e.op.ID] = e
+	q.ids = append(q.ids, e.op.ID)
+
+	// expire the oldest finished operations
+	for len(q.ids) > maxOperations {
+		old := q.ops[q.ids[0]]
+		if old.op.State != OperationDone && old.op.State != OperationFailed {
+			break
+		}
+		delete(q.ops, q.ids[0])
+		q.ids = q.ids[1:]
+	}
+	return e.op, nil
+}
+
+func (q *operationQueue) update(e *operationEntry, f func(*Operation)) {
+	q.mu.Lock()
+	f(&e.op)
+	close(e.changec)
+	e.changec = make(chan struct{})
+	q.mu.Unlock()
+}
+
+// get returns the operation by its ID.
+func (q *operationQueue) get(id string) (Operation, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e, ok := q.ops[id]
+	if !ok {
+		return Operation{}, false
+	}
+	return e.op, true
+}
+
+// wait waits until the operation leaves the given state or the context
+// is done, and returns the latest operation.
+func (q *operationQueue) wait(ctx context.Context, id string, state OperationState) (Operation, bool) {
+	for {
+		q.mu.Lock()
+		e, ok := q.ops[id]
+		if !ok {
+			q.mu.Unlock()
+			return Operation{}, false
+		}
+		op, changec := e.op, e.changec
+		q.mu.Unlock()
+
+		if op.State != state {
+			return op, true
+		}
+		select {
+		case <-changec:
+		case <-ctx.Done():
+			return op, true
+		}
+	}
+}
+
+// operationHandler returns the operation of the 'id' query parameter.
+// If 'wait' is given, it blocks until the operation leaves that state
+// (e.g. 'wait=running'), so that clients can subscribe by long polling.
+func (srv *Server) operationHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	case http.MethodGet:
+		id := req.URL.Query().Get("id")
+		op, ok := srv.operations.get(id)
+		if ok {
+			if state := req.URL.Query().Get("wait"); state != "" {
+				wctx, wcancel := context.WithTimeout(req.Context(), operationWaitTimeout)
+				op, ok = srv.operations.wait(wctx, id, OperationState(state))
+				wcancel()
+			}
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("operation %q not found", id), http.StatusNotFound)
+			return nil
+		}
+		if err := json.NewEncoder(w).Encode(op); err != nil {
+			return err
+		}
+
+	default:
+		http.Error(w, "Method Not Allowed", 405)
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/pkg/types"
+)
+
+// allKeysFrom is the range end of all keys from the key.
+const allKeysFrom = "\x00"
+
+var sortTargets = map[string]clientv3.SortTarget{
+	"key":     clientv3.SortByKey,
+	"version": clientv3.SortByVersion,
+	"create":  clientv3.SortByCreateRevision,
+	"mod":     clientv3.SortByModRevision,
+	"value":   clientv3.SortByValue,
+}
+
+var sortOrders = map[string]clientv3.SortOrder{
+	"":        clientv3.SortNone,
+	"ascend":  clientv3.SortAscend,
+	"descend": clientv3.SortDescend,
+}
+
+// rangeKey returns the key of the range of 'get' and 'history'. An empty
+// key with a range end starts from the lowest key instead, since the
+// namespace client rejects empty keys, and no key is ever empty.
+func (creq *ClientRequest) rangeKey() string {
+	if creq.KeyValue.Key == "" {
+		return allKeysFrom
+	}
+	return creq.KeyValue.Key
+}
+
+// rangeOptions returns the options of the range of 'get' and 'delete'.
+// The options other than the range end are only valid for 'get'.
+func (creq *ClientRequest) rangeOptions() ([]clientv3.OpOption, error) {
+	var opts []clientv3.OpOption
+	switch {
+	case creq.RangeEnd == allKeysFrom, creq.RangePrefix && creq.KeyValue.Key == "":
+		// the prefix of an empty key is all keys
+		opts = append(opts, clientv3.WithFromKey())
+	case creq.RangeEnd != "":
+		if creq.RangeEnd <= creq.KeyValue.Key {
+			return nil, fmt.Errorf("range end %q must be greater than key %q", creq.RangeEnd, creq.KeyValue.Key)
+		}
+		opts = append(opts, clientv3.WithRange(creq.RangeEnd))
+	case creq.RangePrefix:
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if creq.Action != "get" {
+		return opts, nil
+	}
+
+	if creq.Limit < 0 {
+		return nil, fmt.Errorf("negative limit %d", creq.Limit)
+	}
+	if creq.Limit > 0 {
+		opts = append(opts, clientv3.WithLimit(creq.Limit))
+	}
+	order, ok := sortOrders[creq.SortOrder]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort order %q", creq.SortOrder)
+	}
+	if creq.SortTarget != "" || order != clientv3.SortNone {
+		target, ok := sortTargets[creq.SortTarget]
+		if !ok && creq.SortTarget != "" {
+			return nil, fmt.Errorf("unknown sort target %q", creq.SortTarget)
+		}
+		if order == clientv3.SortNone {
+			order = clientv3.SortAscend
+		}
+		opts = append(opts, clientv3.WithSort(target, order))
+	}
+	if creq.KeysOnly {
+		opts = append(opts, clientv3.WithKeysOnly())
+	}
+	if creq.CountOnly {
+		opts = append(opts, clientv3.WithCountOnly())
+	}
+	if creq.Revision < 0 {
+		return nil, fmt.Errorf("negative revision %d", creq.Revision)
+	}
+	if creq.Revision > 0 {
+		opts = append(opts, clientv3.WithRev(creq.Revision))
+	}
+	if creq.Serializable {
+		opts = append(opts, clientv3.WithSerializable())
+	}
+	return opts, nil
+}
+
+// setHeader sets the revision, raft term and serving member of the
+// response header.
+func (cresp *ClientResponse) setHeader(backend Backend, h *pb.ResponseHeader) {
+	if h == nil {
+		return
+	}
+	cresp.Revision, cresp.RaftTerm = h.Revision, h.RaftTerm
+	if h.MemberId != 0 {
+		cresp.MemberID = types.ID(h.MemberId).String()
+		if m, err := backend.Member(cresp.MemberID); err == nil {
+			cresp.MemberName, cresp.Endpoint = m.Name, servedEndpoint(m, cresp.ClientRequest.Endpoints)
+		}
+	}
+}
+
+// servedEndpoint returns the endpoint of the member among the endpoints
+// of the request, or its first client URL if none matches.
+func servedEndpoint(m MemberInfo, eps []string) string {
+	for _, ep := range eps {
+		for _, mep := range m.Endpoints {
+			if endpointHost(ep) == endpointHost(mep) {
+				return ep
+			}
+		}
+	}
+	if len(m.Endpoints) == 0 {
+		return ""
+	}
+	return m.Endpoints[0]
+}
+
+// balancedLine describes the member that served the request through
+// the client balancer.
+func (cresp *ClientResponse) balancedLine() string {
+	return fmt.Sprintf("served by %s (%s) through the balancer of %d endpoints", cresp.MemberName, cresp.Endpoint, len(cresp.ClientRequest.Endpoints))
+}
+
+func toKeyValue(kv *mvccpb.KeyValue) KeyValue {
+	v := KeyValue{
+		Key:            string(kv.Key),
+		Value:          string(kv.Value),
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+	}
+	if kv.Lease != 0 {
+		v.Lease = leaseIDString(clientv3.LeaseID(kv.Lease))
+	}
+	return v
+}
+
+func toKeyValues(kvs []*mvccpb.KeyValue) []KeyValue {
+	vs := make([]KeyValue, len(kvs))
+	for i := range kvs {
+		vs[i] = toKeyValue(kvs[i])
+	}
+	return vs
+}
+
+// keyValueLine describes the key-value in the result of the action.
+func keyValueLine(act string, kv KeyValue) string {
+	s := fmt.Sprintf("'%s' success (key: %s, value: %s", act, kv.Key, kv.Value)
+	if kv.ModRevision != 0 {
+		s += fmt.Sprintf(", create revision: %d, mod revision: %d, version: %d", kv.CreateRevision, kv.ModRevision, kv.Version)
+	}
+	if kv.Lease != "" {
+		s += ", lease: " + kv.Lease
+	}
+	return s + ")"
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/etcd-io/etcdlabs/pkg/ratelimit"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimitPolicy limits the requests of each user to routes, or to
+// client request actions.
+type RateLimitPolicy struct {
+	// Name identifies the policy in metrics and in the etcd keys of
+	// RateLimitClient. Defaults to the routes and actions joined by commas.
+	Name string
+
+	// Routes are the paths limited by the policy (e.g. "/client-request").
+	Routes []string
+	// Actions are the client request actions limited by the policy
+	// (e.g. "stop-node"), sharing the limit.
+	Actions []string
+
+	// Interval is the minimum interval between requests of a user.
+	Interval time.Duration
+	// Burst is the number of requests a user can make at once.
+	// Defaults to RateLimitBurst.
+	Burst int
+	// GlobalInterval is the minimum interval between requests of all users.
+	// Zero disables the global ceiling.
+	GlobalInterval time.Duration
+}
+
+// defaultRateLimitPolicies returns the policies of the interval settings.
+func (cfg *ServerConfig) defaultRateLimitPolicies() []RateLimitPolicy {
+	return []RateLimitPolicy{
+		{
+			Name:           "client-request",
+			Routes:         []string{"/client-request"},
+			Interval:       cfg.ClientRequestInterval,
+			GlobalInterval: cfg.GlobalClientRequestInterval,
+		},
+		{
+			Name:           "stop-restart",
+			Actions:        []string{"stop-node", "restart-node", "replace-node"},
+			Interval:       cfg.StopRestartInterval,
+			GlobalInterval: cfg.GlobalStopRestartInterval,
+		},
+	}
+}
+
+// policyLimiter is the limiter of a policy, keyed by user ID.
+type policyLimiter struct {
+	name     string
+	lim      ratelimit.KeyedLimiter
+	rejected prometheus.Counter
+}
+
+// newRateLimiters returns the limiters of the policies by route and by action,
+// registering the rejection counters to the registry.
+func (cfg *ServerConfig) newRateLimiters(reg *prometheus.Registry) (routes, actions map[string]*policyLimiter) {
+	rejected := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "etcdlabs",
+		Subsystem: "ratelimit",
+		Name:      "rejected_total",
+		Help:      "Total number of requests rejected by the rate limit policy.",
+	}, []string{"policy"})
+	reg.MustRegister(rejected)
+
+	routes, actions = make(map[string]*policyLimiter), make(map[string]*policyLimiter)
+	for _, p := range cfg.RateLimitPolicies {
+		pl := &policyLimiter{
+			name: p.Name,
+			lim: cfg.newLimiter(p.Name, ratelimit.KeyedConfig{
+				Interval:       p.Interval,
+				Burst:          p.Burst,
+				MaxKeys:        cfg.MaxRateLimitedUsers,
+				GlobalInterval: p.GlobalInterval,
+			}),
+			rejected: rejected.WithLabelValues(p.Name),
+		}
+		for _, r := range p.Routes {
+			routes[r] = pl
+		}
+		for _, a := range p.Actions {
+			actions[a] = pl
+		}
+	}
+	return routes, actions
+}
+
+// checkRateLimit counts the request of the user, and sets the rate limit
+// headers. If the user is over the limit, it responds with 429 Too Many
+// Requests and the client response of the message, and returns false.
+func (srv *Server) checkRateLimit(w http.ResponseWriter, pl *policyLimiter, userID, what string) bool {
+	res := pl.lim.Take(userID)
+
+	// keep the headers of the stricter policy, if already checked
+	h := w.Header()
+	if prev, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); !res.OK || err != nil || res.Remaining < prev {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	}
+	if res.OK {
+		return true
+	}
+
+	pl.rejected.Inc()
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	cresp := ClientResponse{Success: false, Result: what + " " + res.Message()}
+	cresp.ResultLines = []string{cresp.Result}
+	lg.Info(cresp.Result)
+	if err := json.NewEncoder(w).Encode(cresp); err != nil {
+		lg.Warnf("failed to write response (%v)", err)
+	}
+	return false
+}
+
+// routeRequestName returns the name of the requests to the route in
+// messages (e.g. "client request" for "/client-request").
+func routeRequestName(route string) string {
+	return strings.Replace(strings.TrimPrefix(route, "/"), "-", " ", -1)
+}
+
+// ceilSeconds returns the duration in seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,292 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster"
+)
+
+// sandboxPortRange is the number of ports reserved for each user cluster,
+// including the ones for replaced members.
+const sandboxPortRange = 100
+
+func (srv *Server) allocSandboxPort() int {
+	srv.sandboxPortMu.Lock()
+	defer srv.sandboxPortMu.Unlock()
+	if n := len(srv.freeSandboxPorts); n > 0 {
+		port := srv.freeSandboxPorts[n-1]
+		srv.freeSandboxPorts = srv.freeSandboxPorts[:n-1]
+		return port
+	}
+	port := srv.sandboxPort
+	srv.sandboxPort += sandboxPortRange
+	return port
+}
+
+func (srv *Server) releaseSandboxPort(port int) {
+	srv.sandboxPortMu.Lock()
+	srv.freeSandboxPorts = append(srv.freeSandboxPorts, port)
+	srv.sandboxPortMu.Unlock()
+}
+
+var (
+	errTooManySandboxes = errors.New("too many clusters are running; try again later")
+	errSandboxDiskFull  = errors.New("disk quota for clusters is exceeded; try again later")
+)
+
+// sandbox is the cluster dedicated to a user.
+type sandbox struct {
+	// readyc is closed when the cluster is started or failed to start.
+	readyc  chan struct{}
+	backend Backend
+	err     error
+
+	// dir and port are set for embedded clusters.
+	dir  string
+	port int
+}
+
+// findUserBackend returns the cluster backend of the user, if started.
+// Unlike userBackend, it never creates a cluster, so that viewing the
+// status does not start clusters.
+func (srv *Server) findUserBackend(userID string) (Backend, bool) {
+	if !srv.cfg.Sandbox {
+		return srv.backend, true
+	}
+
+	srv.sandboxMu.Lock()
+	sb, ok := srv.sandboxes[userID]
+	srv.sandboxMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	select {
+	case <-sb.readyc:
+		return sb.backend, sb.err == nil
+	default:
+		return nil, false
+	}
+}
+
+// userBackend returns the cluster backend of the user. In sandbox mode,
+// it creates the user's cluster on first request, and waits until it is started.
+func (srv *Server) userBackend(ctx context.Context, userID string) (Backend, error) {
+	if !srv.cfg.Sandbox {
+		return srv.backend, nil
+	}
+
+	srv.sandboxMu.Lock()
+	sb, ok := srv.sandboxes[userID]
+	if !ok {
+		if len(srv.sandboxes) >= srv.cfg.MaxSandboxes {
+			srv.sandboxMu.Unlock()
+			return nil, errTooManySandboxes
+		}
+		if srv.sandboxDiskBytes >= srv.cfg.MaxSandboxDiskBytes {
+			srv.sandboxMu.Unlock()
+			return nil, errSandboxDiskFull
+		}
+		sb = &sandbox{readyc: make(chan struct{})}
+		srv.sandboxes[userID] = sb
+		go srv.startSandbox(userID, sb)
+	}
+	srv.sandboxMu.Unlock()
+
+	select {
+	case <-sb.readyc:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if sb.err != nil {
+		return nil, sb.err
+	}
+	return sb.backend, nil
+}
+
+func (srv *Server) startSandbox(userID string, sb *sandbox) {
+	defer close(sb.readyc)
+
+	lg.Infof("starting cluster for user %q", userID)
+	now := time.Now()
+	if srv.cfg.NewSandbox != nil {
+		sb.backend, sb.err = srv.cfg.NewSandbox(srv.rootCtx)
+	} else {
+		sb.backend, sb.err = srv.startEmbeddedSandbox(sb)
+	}
+	if sb.err != nil {
+		lg.Warnf("failed to start cluster for user %q (%v)", userID, sb.err)
+
+		// allow retries from the next request
+		srv.sandboxMu.Lock()
+		if srv.sandboxes[userID] == sb {
+			delete(srv.sandboxes, userID)
+		}
+		srv.sandboxMu.Unlock()
+		return
+	}
+	lg.Infof("started cluster for user %q (took %v)", userID, time.Since(now))
+}
+
+func (srv *Server) startEmbeddedSandbox(sb *sandbox) (Backend, error) {
+	dir, err := ioutil.TempDir(os.TempDir(), "backend-sandbox")
+	if err != nil {
+		return nil, err
+	}
+	sb.dir, sb.port = dir, srv.allocSandboxPort()
+
+	ccfg := srv.cfg.Cluster
+	ccfg.RootDir, ccfg.RootPort = sb.dir, sb.port
+
+	// cancel only this cluster on shutdown
+	ctx, cancel := context.WithCancel(srv.rootCtx)
+	c, err := startCluster(ctx, cancel, ccfg)
+	if err != nil {
+		cancel()
+		if _, ok := err.(*cluster.StartError); ok {
+			// members may still hold the ports and the data
+			return nil, err
+		}
+		os.RemoveAll(sb.dir)
+		srv.releaseSandboxPort(sb.port)
+		return nil, err
+	}
+	return NewEmbeddedBackend(c), nil
+}
+
+// checkSandboxDisk updates the disk usage of user clusters every interval.
+func (srv *Server) checkSandboxDisk() {
+	for {
+		select {
+		case <-srv.stopc:
+			return
+		case <-time.After(srv.cfg.SandboxDiskInterval):
+		}
+
+		n := srv.sandboxDiskUsage()
+		srv.sandboxMu.Lock()
+		srv.sandboxDiskBytes = n
+		srv.sandboxMu.Unlock()
+		if n >= srv.cfg.MaxSandboxDiskBytes {
+			lg.Warnf("user clusters use %d bytes over the disk quota %d", n, srv.cfg.MaxSandboxDiskBytes)
+		}
+	}
+}
+
+// sandboxDiskFull returns true if user clusters used up the disk quota at the last check.
+func (srv *Server) sandboxDiskFull() bool {
+	srv.sandboxMu.Lock()
+	defer srv.sandboxMu.Unlock()
+	return srv.sandboxDiskBytes >= srv.cfg.MaxSandboxDiskBytes
+}
+
+// sandboxDiskUsage returns the total bytes of the user cluster directories.
+// The directories are walked without 'sandboxMu' locked.
+func (srv *Server) sandboxDiskUsage() (n int64) {
+	var dirs []string
+	srv.sandboxMu.Lock()
+	for _, sb := range srv.sandboxes {
+		select {
+		case <-sb.readyc:
+		default:
+			continue // still starting; 'dir' may not be set
+		}
+		if sb.dir != "" {
+			dirs = append(dirs, sb.dir)
+		}
+	}
+	srv.sandboxMu.Unlock()
+
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n += info.Size()
+			}
+			return nil
+		})
+	}
+	return n
+}
+
+// sandboxBackends returns the backends of the started user clusters.
+func (srv *Server) sandboxBackends() []Backend {
+	srv.sandboxMu.Lock()
+	defer srv.sandboxMu.Unlock()
+
+	var bs []Backend
+	for _, sb := range srv.sandboxes {
+		select {
+		case <-sb.readyc:
+			if sb.err == nil {
+				bs = append(bs, sb.backend)
+			}
+		default:
+		}
+	}
+	return bs
+}
+
+// reclaimSandboxes shuts down the clusters of the users for whom keep
+// returns false.
+func (srv *Server) reclaimSandboxes(keep func(userID string) bool) {
+	srv.sandboxMu.Lock()
+	var sbs []*sandbox
+	for userID, sb := range srv.sandboxes {
+		if keep(userID) {
+			continue
+		}
+		lg.Infof("reclaiming cluster of user %q", userID)
+		delete(srv.sandboxes, userID)
+		sbs = append(sbs, sb)
+	}
+	srv.sandboxMu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(sbs))
+	for _, sb := range sbs {
+		go func(sb *sandbox) {
+			defer wg.Done()
+			srv.shutdownSandbox(sb)
+		}(sb)
+	}
+	wg.Wait()
+}
+
+func (srv *Server) shutdownSandbox(sb *sandbox) {
+	<-sb.readyc
+	if sb.err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterShutdownTimeout)
+	err := sb.backend.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		// members may still hold the ports
+		lg.Warnf("failed to shut down user cluster (%v)", err)
+		return
+	}
+	if sb.dir != "" {
+		os.RemoveAll(sb.dir)
+		srv.releaseSandboxPort(sb.port)
+	}
+}
@@ -16,11 +16,13 @@ package web
 
 import (
 	"context"
-	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,78 +30,331 @@ import (
 	"github.com/etcd-io/etcdlabs/pkg/ratelimit"
 
 	"github.com/axiomhq/hyperloglog"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	rootPortMu sync.Mutex
-	rootPort   = 2389
+	clusterStartTimeout    = time.Minute
+	clusterShutdownTimeout = 30 * time.Second
 )
 
-func startCluster(rootCtx context.Context, rootCancel func()) (*cluster.Cluster, error) {
-	rootPortMu.Lock()
-	port := rootPort
-	rootPort += 10 // for testing
-	rootPortMu.Unlock()
+// ServerConfig configures a backend webserver.
+// Zero values are replaced with defaults.
+type ServerConfig struct {
+	// Addr is the listen address (e.g. "localhost:2200").
+	Addr string
 
-	dir, err := ioutil.TempDir(os.TempDir(), "backend-cluster")
-	if err != nil {
-		return nil, err
+	// Backend is the cluster to operate on. If nil, an embedded
+	// cluster is started with Cluster. The caller owns the given
+	// backend, so the server does not shut it down.
+	Backend Backend
+
+	// Cluster configures the playground cluster. If Size is zero,
+	// a 5-node cluster with embedded clients is started (3-node for
+	// sandboxes). RootPort defaults to 2389, RootDir is allocated if
+	// empty, and RootCtx and RootCancel are always set by the server.
+	Cluster cluster.Config
+
+	// Sandbox gives each user a dedicated cluster configured by Cluster,
+	// instead of sharing one. The cluster is started on the user's first
+	// request, and reclaimed when the user expires from the cache.
+	Sandbox bool
+	// NewSandbox creates the backend of a user cluster.
+	// If nil, an embedded cluster is started.
+	NewSandbox func(ctx context.Context) (Backend, error)
+	// MaxSandboxes limits the number of user clusters.
+	MaxSandboxes int
+	// MaxSandboxDiskBytes limits the total disk usage of user clusters.
+	// While the usage is over the limit, no cluster is created and writes
+	// to the clusters are rejected, until inactive users' clusters are reclaimed.
+	MaxSandboxDiskBytes int64
+	// SandboxDiskInterval is the interval to check the disk usage of user clusters.
+	SandboxDiskInterval time.Duration
+	// SandboxRootPort is the root port of the first user cluster.
+	// Each user cluster reserves 100 ports from it.
+	SandboxRootPort int
+
+	// Namespace isolates the keys of each user on the shared cluster
+	// with a per-user key prefix. The keys are deleted when the user
+	// expires from the cache. It is ignored in sandbox mode.
+	Namespace bool
+
+	// StatusInterval is the interval to update member statuses, while
+	// they are streamed or polled.
+	StatusInterval time.Duration
+	// StatusTimeout is the timeout of each member status update.
+	StatusTimeout time.Duration
+
+	// ClientRequestInterval is the minimum interval between client
+	// requests of a user.
+	ClientRequestInterval time.Duration
+	// StopRestartInterval is the minimum interval between node
+	// operations of a user.
+	StopRestartInterval time.Duration
+	// RateLimitBurst is the number of requests a user can make at once.
+	RateLimitBurst int
+	// GlobalClientRequestInterval is the minimum interval between client
+	// requests of all users. Defaults to a tenth of ClientRequestInterval.
+	GlobalClientRequestInterval time.Duration
+	// GlobalStopRestartInterval is the minimum interval between node
+	// operations of all users. Defaults to a fifth of StopRestartInterval.
+	GlobalStopRestartInterval time.Duration
+	// MaxRateLimitedUsers bounds the number of users tracked by each limiter.
+	MaxRateLimitedUsers int
+	// RateLimitPolicies limit the requests of users by route and by client
+	// request action. If nil, the policies of ClientRequestInterval and
+	// StopRestartInterval are used. Rejected requests are counted in '/metrics'.
+	RateLimitPolicies []RateLimitPolicy
+	// RateLimitClient stores the rate limit state of users in its etcd
+	// cluster, so that the limits are shared by all servers behind a load
+	// balancer. If nil, the state is kept in memory.
+	RateLimitClient *clientv3.Client
+
+	// UserCacheInterval is the interval to expire inactive users.
+	UserCacheInterval time.Duration
+	// UserInactiveTimeout is the duration after which a user is expired.
+	UserInactiveTimeout time.Duration
+}
+
+const (
+	defaultAddr     = "localhost:2200"
+	defaultRootPort = 2389
+
+	defaultSandboxRootPort = 22379
+)
+
+func (cfg *ServerConfig) setDefaults() {
+	if cfg.Addr == "" {
+		cfg.Addr = defaultAddr
+	}
+	if cfg.Cluster.Size == 0 {
+		cfg.Cluster.Size = 5
+		if cfg.Sandbox {
+			cfg.Cluster.Size = 3
+		}
+		cfg.Cluster.EmbeddedClient = true
+	}
+	if cfg.Cluster.RootPort == 0 {
+		cfg.Cluster.RootPort = defaultRootPort
+	}
+	if cfg.MaxSandboxes == 0 {
+		cfg.MaxSandboxes = 10
+	}
+	if cfg.MaxSandboxDiskBytes == 0 {
+		cfg.MaxSandboxDiskBytes = 4 << 30
+	}
+	if cfg.SandboxDiskInterval == 0 {
+		cfg.SandboxDiskInterval = 10 * time.Second
+	}
+	if cfg.SandboxRootPort == 0 {
+		cfg.SandboxRootPort = defaultSandboxRootPort
+	}
+	if cfg.StatusInterval == 0 {
+		cfg.StatusInterval = time.Second
+	}
+	if cfg.StatusTimeout == 0 {
+		cfg.StatusTimeout = 5 * time.Second
+	}
+	if cfg.ClientRequestInterval == 0 {
+		cfg.ClientRequestInterval = 3 * time.Second
+	}
+	if cfg.StopRestartInterval == 0 {
+		cfg.StopRestartInterval = 5 * time.Second
+	}
+	if cfg.RateLimitBurst == 0 {
+		cfg.RateLimitBurst = 1
+	}
+	if cfg.GlobalClientRequestInterval == 0 {
+		cfg.GlobalClientRequestInterval = cfg.ClientRequestInterval / 10
 	}
+	if cfg.GlobalStopRestartInterval == 0 {
+		cfg.GlobalStopRestartInterval = cfg.StopRestartInterval / 5
+	}
+	if cfg.MaxRateLimitedUsers == 0 {
+		cfg.MaxRateLimitedUsers = 10000
+	}
+	if cfg.RateLimitPolicies == nil {
+		cfg.RateLimitPolicies = cfg.defaultRateLimitPolicies()
+	} else {
+		cfg.RateLimitPolicies = append([]RateLimitPolicy(nil), cfg.RateLimitPolicies...)
+	}
+	for i, p := range cfg.RateLimitPolicies {
+		if p.Name == "" {
+			cfg.RateLimitPolicies[i].Name = strings.Join(append(append([]string(nil), p.Routes...), p.Actions...), ",")
+		}
+		if p.Burst == 0 {
+			cfg.RateLimitPolicies[i].Burst = cfg.RateLimitBurst
+		}
+	}
+	if cfg.UserCacheInterval == 0 {
+		cfg.UserCacheInterval = 5 * time.Minute
+	}
+	if cfg.UserInactiveTimeout == 0 {
+		cfg.UserInactiveTimeout = 15 * time.Minute
+	}
+}
+
+// rateLimitPrefix is the key prefix of the rate limit state in etcd.
+const rateLimitPrefix = "/etcdlabs/ratelimit/"
+
+// newLimiter returns the limiter of users, shared through etcd with RateLimitClient.
+func (cfg *ServerConfig) newLimiter(name string, kcfg ratelimit.KeyedConfig) ratelimit.KeyedLimiter {
+	if cfg.RateLimitClient == nil {
+		return ratelimit.NewKeyedLimiter(kcfg)
+	}
+	return ratelimit.NewEtcdKeyedLimiter(ratelimit.EtcdConfig{
+		KeyedConfig: kcfg,
+		Client:      cfg.RateLimitClient,
+		Prefix:      rateLimitPrefix + name + "/",
+		OnError: func(err error) {
+			lg.Warnf("%s rate limit falls back to local (%v)", name, err)
+		},
+	})
+}
 
-	cfg := cluster.Config{
-		EmbeddedClient: true,
-		Size:           5,
-		RootDir:        dir,
-		RootPort:       port,
-		ClientAutoTLS:  false,
-		PeerAutoTLS:    false,
-		RootCtx:        rootCtx,
-		RootCancel:     rootCancel,
+func startCluster(rootCtx context.Context, rootCancel func(), cfg cluster.Config) (*cluster.Cluster, error) {
+	if cfg.RootDir == "" {
+		dir, err := ioutil.TempDir(os.TempDir(), "backend-cluster")
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootDir = dir
 	}
-	return cluster.Start(cfg)
+	cfg.RootCtx, cfg.RootCancel = rootCtx, rootCancel
+
+	ctx, cancel := context.WithTimeout(rootCtx, clusterStartTimeout)
+	defer cancel()
+	return cluster.Start(ctx, cfg)
 }
 
 // Server warps http.Server.
 type Server struct {
 	mu         sync.RWMutex
+	cfg        ServerConfig
+	webPort    int
 	addrURL    url.URL
 	httpServer *http.Server
 
-	rootCancel func()
-	stopc      chan struct{}
-	donec      chan struct{}
-}
+	// backend is nil in sandbox mode, and
+	// ownsBackend is true if the server started it
+	backend     Backend
+	ownsBackend bool
 
-var (
-	globalWebserverPort int
+	sandboxMu sync.Mutex
+	sandboxes map[string]*sandbox
+	// sandboxDiskBytes is the disk usage of user clusters at the last check
+	sandboxDiskBytes int64
 
-	globalCluster        *cluster.Cluster
-	globalServerVisitsMu sync.Mutex
-	globalServerVisits   = hyperloglog.New16()
+	// sandboxPort is the next root port of user clusters, and
+	// freeSandboxPorts are the root ports of reclaimed ones
+	sandboxPortMu    sync.Mutex
+	sandboxPort      int
+	freeSandboxPorts []int
 
-	globalClientRequestIntervalLimit = 3 * time.Second
-	globalClientRequestLimiter       ratelimit.RequestLimiter
+	// namespaceUsers are the users who have keys in their namespaces
+	namespaceMu    sync.Mutex
+	namespaceUsers map[string]struct{}
 
-	globalStopRestartIntervalLimit = 5 * time.Second
-	globalStopRestartLimiter       ratelimit.RequestLimiter
-)
+	visitsMu sync.Mutex
+	visits   *hyperloglog.Sketch
+
+	userCacheMu sync.RWMutex
+	userCache   map[string]userData
+
+	// rate limiters of the policies by route and by client request action
+	routeLimiters  map[string]*policyLimiter
+	actionLimiters map[string]*policyLimiter
+	metrics        *prometheus.Registry
+
+	operations *operationQueue
+
+	watchMu  sync.Mutex
+	watchSeq int64
+	watches  map[string]*watchSession
+
+	leaseMu     sync.Mutex
+	leases      map[leaseKey]*userLease
+	leaseGrants map[string]int // grants in progress by user ID
+
+	// readers of member statuses, to update them only when needed
+	statusMu     sync.Mutex
+	statusSubs   map[chan struct{}]struct{}
+	statusPolled time.Time
+	statusKickc  chan struct{}
+
+	rootCtx    context.Context
+	rootCancel func()
+	stopc      chan struct{}
+	donec      chan struct{}
+}
 
 // StartServer starts a backend webserver with stoppable listener.
-func StartServer(port int) (*Server, error) {
-	globalWebserverPort = port
+func StartServer(cfg ServerConfig) (*Server, error) {
+	cfg.setDefaults()
+	_, portStr, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
 
-	rootCtx, rootCancel := context.WithCancel(context.Background())
-	c, err := startCluster(rootCtx, rootCancel)
+	// listen before starting the cluster, so that requests
+	// are accepted as soon as the server is returned
+	ln, err := net.Listen("tcp", cfg.Addr)
 	if err != nil {
 		return nil, err
 	}
-	globalCluster = c
 
-	// allow only 1 request for every 2 second
-	globalClientRequestLimiter = ratelimit.NewRequestLimiter(rootCtx, globalClientRequestIntervalLimit)
+	rootCtx, rootCancel := context.WithCancel(context.Background())
+	backend := cfg.Backend
+	if backend == nil && !cfg.Sandbox {
+		c, err := startCluster(rootCtx, rootCancel, cfg.Cluster)
+		if err != nil {
+			rootCancel()
+			ln.Close()
+			return nil, err
+		}
+		backend = NewEmbeddedBackend(c)
+	}
+
+	addrURL := url.URL{Scheme: "http", Host: cfg.Addr}
+	srv := &Server{
+		cfg:     cfg,
+		webPort: port,
+		addrURL: addrURL,
+		backend: backend,
+
+		ownsBackend: cfg.Backend == nil,
+
+		sandboxes:      make(map[string]*sandbox),
+		sandboxPort:    cfg.SandboxRootPort,
+		namespaceUsers: make(map[string]struct{}),
+
+		visits: hyperloglog.New16(),
+
+		userCache: make(map[string]userData),
+
+		metrics: prometheus.NewRegistry(),
+
+		operations: newOperationQueue(rootCtx),
+
+		watches:     make(map[string]*watchSession),
+		leases:      make(map[leaseKey]*userLease),
+		leaseGrants: make(map[string]int),
 
-	// rate-limit more strictly for every 3 second
-	globalStopRestartLimiter = ratelimit.NewRequestLimiter(rootCtx, globalStopRestartIntervalLimit)
+		statusSubs:  make(map[chan struct{}]struct{}),
+		statusKickc: make(chan struct{}, 1),
+
+		rootCtx:    rootCtx,
+		rootCancel: rootCancel,
+		stopc:      make(chan struct{}),
+		donec:      make(chan struct{}),
+	}
+	srv.routeLimiters, srv.actionLimiters = cfg.newRateLimiters(srv.metrics)
 
 	mux := http.NewServeMux()
 	mux.Handle("/health", &ContextAdapter{
@@ -110,29 +365,34 @@ func StartServer(port int) (*Server, error) {
 			return nil
 		}),
 	})
+	mux.Handle("/metrics", promhttp.HandlerFor(srv.metrics, promhttp.HandlerOpts{}))
 	mux.Handle("/conn", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(connectHandler)),
+		handler: srv.withCache(ContextHandlerFunc(srv.connectHandler)),
 	})
 	mux.Handle("/server-status", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(serverStatusHandler)),
+		handler: srv.withCache(ContextHandlerFunc(srv.serverStatusHandler)),
+	})
+	mux.Handle("/server-status-stream", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: srv.withCache(ContextHandlerFunc(srv.serverStatusStreamHandler)),
 	})
 	mux.Handle("/client-request", &ContextAdapter{
 		ctx:     rootCtx,
-		handler: withCache(ContextHandlerFunc(clientRequestHandler)),
+		handler: srv.withCache(ContextHandlerFunc(srv.clientRequestHandler)),
 	})
-
-	stopc := make(chan struct{})
-	addrURL := url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", port)}
+	mux.Handle("/operation", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: srv.withCache(ContextHandlerFunc(srv.operationHandler)),
+	})
+	mux.Handle("/watch", &ContextAdapter{
+		ctx:     rootCtx,
+		handler: srv.withCache(ContextHandlerFunc(srv.watchHandler)),
+	})
+	hs := &http.Server{Addr: addrURL.Host, Handler: mux}
+	srv.httpServer = hs
 	lg.Infof("started server %s", addrURL.String())
-	srv := &Server{
-		addrURL:    addrURL,
-		httpServer: &http.Server{Addr: addrURL.Host, Handler: mux},
-		rootCancel: rootCancel,
-		stopc:      stopc,
-		donec:      make(chan struct{}),
-	}
 
 	go func() {
 		defer func() {
@@ -144,36 +404,57 @@ func StartServer(port int) (*Server, error) {
 			close(srv.donec)
 		}()
 
-		go func() { updateClusterStatus(srv.stopc) }()
-		go func() { cleanCache(srv.stopc) }()
-		if err := srv.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		go srv.updateClusterStatus()
+		go srv.cleanCache()
+		if srv.cfg.Sandbox {
+			go srv.checkSandboxDisk()
+		}
+		if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
 			lg.Fatal(err)
 		}
 	}()
 	return srv, nil
 }
 
+// Backend returns the cluster backend of the server,
+// or nil in sandbox mode.
+func (srv *Server) Backend() Backend {
+	return srv.backend
+}
+
 // StopNotify returns receive-only stop channel to notify the server has stopped.
 func (srv *Server) StopNotify() <-chan struct{} {
 	return srv.stopc
 }
 
 // Stop stops the server. Useful for testing.
+// It is safe to call more than once.
 func (srv *Server) Stop() {
-	lg.Warnf("stopping server %s", srv.addrURL.String())
 	srv.mu.Lock()
 	if srv.httpServer == nil {
 		srv.mu.Unlock()
 		return
 	}
+	lg.Warnf("stopping server %s", srv.addrURL.String())
 	close(srv.stopc)
 	srv.httpServer.Close()
+	srv.httpServer = nil
 	<-srv.donec
 	srv.mu.Unlock()
 	lg.Warnf("stopped server %s", srv.addrURL.String())
 
+	srv.reclaimSandboxes(func(string) bool { return false })
+	if !srv.ownsBackend || srv.backend == nil {
+		return
+	}
+
 	lg.Warn("stopping cluster")
-	globalCluster.Shutdown()
-	globalCluster = nil
+	ctx, cancel := context.WithTimeout(context.Background(), clusterShutdownTimeout)
+	err := srv.backend.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		lg.Warnf("failed to stop cluster (%v)", err)
+		return
+	}
 	lg.Warn("stopped cluster")
 }
@@ -15,21 +15,81 @@
 package web
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster"
+	"github.com/etcd-io/etcdlabs/cluster/clusterpb"
+
+	"github.com/coreos/etcd/clientv3"
 )
 
 var (
 	testMu       sync.Mutex
 	testBasePort = 35000
+	testRootPort = 36000
 )
 
+// testClusterPort returns the root port of a test cluster, leaving room
+// for the ports of replaced members.
+func testClusterPort() int {
+	testMu.Lock()
+	defer testMu.Unlock()
+	port := testRootPort
+	testRootPort += 20
+	return port
+}
+
+func testEndpoints(t *testing.T, srv *Server, name string, scheme bool) []string {
+	m, err := srv.backend.Member(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheme {
+		return m.Endpoints
+	}
+	eps := make([]string, len(m.Endpoints))
+	for i, ep := range m.Endpoints {
+		eps[i] = endpointHost(ep)
+	}
+	return eps
+}
+
+// testWaitOperation long-polls '/operation' until the operation finishes.
+func testWaitOperation(t *testing.T, srv *Server, id string) Operation {
+	ou := srv.addrURL
+	ou.Path = "/operation"
+	for _, state := range []OperationState{OperationQueued, OperationRunning} {
+		ou.RawQuery = url.Values{"id": {id}, "wait": {string(state)}}.Encode()
+		resp, err := http.Get(ou.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var op Operation
+		err = json.NewDecoder(resp.Body).Decode(&op)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Printf("'/operation' GET response: %+v\n", op)
+		if op.State == OperationDone || op.State == OperationFailed {
+			return op
+		}
+	}
+	t.Fatalf("operation %q did not finish", id)
+	return Operation{}
+}
+
 /*
 go test -v -run TestServer
 */
@@ -40,7 +100,13 @@ func TestServer(t *testing.T) {
 	testBasePort++
 	testMu.Unlock()
 
-	srv, err := StartServer(port)
+	srv, err := StartServer(ServerConfig{
+		Addr:    fmt.Sprintf("localhost:%d", port),
+		Cluster: cluster.Config{RootPort: testClusterPort()},
+
+		// only to test the limit of each user
+		GlobalClientRequestInterval: time.Millisecond,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -78,7 +144,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "stress",
-			Endpoints: globalCluster.Endpoints(0, true),
+			Endpoints: testEndpoints(t, srv, "node1", true),
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -112,7 +178,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "stress",
-			Endpoints: globalCluster.Endpoints(0, false),
+			Endpoints: testEndpoints(t, srv, "node1", false),
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -136,7 +202,7 @@ func TestServer(t *testing.T) {
 	}()
 
 	// remove limiter for testing purposes
-	globalClientRequestLimiter.SetInterval(10 * time.Millisecond)
+	srv.routeLimiters["/client-request"].lim.SetInterval(10 * time.Millisecond)
 
 	println()
 	time.Sleep(7 * time.Second)
@@ -175,7 +241,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "write",
-			Endpoints: globalCluster.Endpoints(1, true),
+			Endpoints: testEndpoints(t, srv, "node2", true),
 			KeyValue:  KeyValue{Key: "foo", Value: "bar"},
 		}
 		data, err := json.Marshal(req)
@@ -213,7 +279,7 @@ func TestServer(t *testing.T) {
 		req := ClientRequest{
 			Action:      "get",
 			RangePrefix: true,
-			Endpoints:   globalCluster.Endpoints(2, true),
+			Endpoints:   testEndpoints(t, srv, "node3", true),
 			KeyValue:    KeyValue{Key: "foo"},
 		}
 		data, err := json.Marshal(req)
@@ -248,7 +314,7 @@ func TestServer(t *testing.T) {
 		req := ClientRequest{
 			Action:      "delete",
 			RangePrefix: true,
-			Endpoints:   globalCluster.Endpoints(3, true),
+			Endpoints:   testEndpoints(t, srv, "node4", true),
 			KeyValue:    KeyValue{Key: "foo"},
 		}
 		data, err := json.Marshal(req)
@@ -279,7 +345,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "get",
-			Endpoints: globalCluster.Endpoints(4, true),
+			Endpoints: testEndpoints(t, srv, "node5", true),
 			KeyValue:  KeyValue{Key: "foo"},
 		}
 		data, err := json.Marshal(req)
@@ -309,8 +375,8 @@ func TestServer(t *testing.T) {
 	fmt.Println("stop node1...")
 	func() {
 		req := ClientRequest{
-			Action:    "stop-node",
-			Endpoints: globalCluster.Endpoints(0, true),
+			Action: "stop-node",
+			Member: "node1",
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -332,8 +398,12 @@ func TestServer(t *testing.T) {
 		if !cresp.Success {
 			t.Fatalf("expected success true, got success %v", cresp.Success)
 		}
-		if !strings.Contains(cresp.Result, "stopped ") {
-			t.Fatalf("expected 'stopped', got %v", cresp)
+		op := testWaitOperation(t, srv, cresp.OperationID)
+		if op.State != OperationDone {
+			t.Fatalf("expected %q, got %+v", OperationDone, op)
+		}
+		if !strings.Contains(op.Result, "stopped ") {
+			t.Fatalf("expected 'stopped', got %v", op)
 		}
 	}()
 
@@ -342,7 +412,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "stop-node",
-			Endpoints: globalCluster.Endpoints(0, true),
+			Endpoints: testEndpoints(t, srv, "node1", true),
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -375,7 +445,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "stress",
-			Endpoints: globalCluster.Endpoints(0, false),
+			Endpoints: testEndpoints(t, srv, "node1", false),
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -407,8 +477,8 @@ func TestServer(t *testing.T) {
 	fmt.Println("restart node1...")
 	func() {
 		req := ClientRequest{
-			Action:    "restart-node",
-			Endpoints: globalCluster.Endpoints(0, true),
+			Action: "restart-node",
+			Member: "node1",
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -430,6 +500,9 @@ func TestServer(t *testing.T) {
 		if !cresp.Success {
 			t.Fatalf("expected success true, got success %v", cresp.Success)
 		}
+		if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+			t.Fatalf("expected %q, got %+v", OperationDone, op)
+		}
 	}()
 
 	println()
@@ -437,7 +510,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "restart-node",
-			Endpoints: globalCluster.Endpoints(0, true),
+			Endpoints: testEndpoints(t, srv, "node1", true),
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -470,7 +543,7 @@ func TestServer(t *testing.T) {
 	func() {
 		req := ClientRequest{
 			Action:    "restart-node",
-			Endpoints: globalCluster.Endpoints(0, true),
+			Endpoints: testEndpoints(t, srv, "node1", true),
 		}
 		data, err := json.Marshal(req)
 		if err != nil {
@@ -497,7 +570,1286 @@ func TestServer(t *testing.T) {
 		}
 	}()
 
+	println()
+	time.Sleep(7 * time.Second)
+	fmt.Println("replace node2...")
+	func() {
+		m, err := srv.backend.Member("node2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldID := m.ID
+
+		req := ClientRequest{
+			Action: "replace-node",
+			Member: "node2",
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Post(tu.String(), "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		cresp := ClientResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&cresp); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Printf("'/client-request' POST response: %+v\n", cresp)
+
+		if !cresp.Success {
+			t.Fatalf("expected success true, got success %v", cresp.Success)
+		}
+		if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+			t.Fatalf("expected %q, got %+v", OperationDone, op)
+		}
+		m, err = srv.backend.Member("node2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ID == oldID {
+			t.Fatalf("expected new member ID, got same %s", oldID)
+		}
+	}()
+
+	func() {
+		ou := srv.addrURL
+		ou.Path = "/operation"
+		ou.RawQuery = "id=unknown"
+		resp, err := http.Get(ou.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+		}
+	}()
+
 	fmt.Println("DONE!")
 
 	srv.Stop()
+	srv.Stop() // no-op
+}
+
+func TestServer_independent(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort += 2
+	testMu.Unlock()
+
+	var srvs []*Server
+	for i, size := range []int{1, 3} {
+		srv, err := StartServer(ServerConfig{
+			Addr:           fmt.Sprintf("localhost:%d", port+i),
+			Cluster:        cluster.Config{Size: size, EmbeddedClient: true, RootPort: testClusterPort()},
+			StatusInterval: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Stop()
+		srvs = append(srvs, srv)
+	}
+
+	// exhaust the limiter of the first server only
+	if _, ok := srvs[0].routeLimiters["/client-request"].lim.Check("user"); !ok {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if _, ok := srvs[0].routeLimiters["/client-request"].lim.Check("user"); ok {
+		t.Fatal("expected the first server to be rate limited")
+	}
+	if _, ok := srvs[1].routeLimiters["/client-request"].lim.Check("user"); !ok {
+		t.Fatal("expected the second server not to be rate limited")
+	}
+
+	for i, size := range []int{1, 3} {
+		resp, err := http.Get(srvs[i].addrURL.String() + "/server-status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sresp := ServerStatus{}
+		err = json.NewDecoder(resp.Body).Decode(&sresp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sresp.MemberStatuses) != size {
+			t.Fatalf("#%d: len(sresp.MemberStatuses) expected %d, got %d", i, size, len(sresp.MemberStatuses))
+		}
+		if sresp.UserN != 1 {
+			t.Fatalf("#%d: expected 1 user, got %d", i, sresp.UserN)
+		}
+	}
+}
+
+// testKeyValuePairs returns the keys and values without metadata.
+func testKeyValuePairs(kvs []KeyValue) []KeyValue {
+	if kvs == nil {
+		return nil
+	}
+	pairs := make([]KeyValue, len(kvs))
+	for i, kv := range kvs {
+		pairs[i] = KeyValue{Key: kv.Key, Value: kv.Value}
+	}
+	return pairs
+}
+
+// testClientRequest posts the request as the user of the given IP,
+// or as the local user if empty.
+func testClientRequest(t *testing.T, srv *Server, ip string, req ClientRequest) ClientResponse {
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq, err := http.NewRequest(http.MethodPost, srv.addrURL.String()+"/client-request", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if ip != "" {
+		hreq.Header.Set("X-Forwarded-For", ip)
+	}
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	cresp := ClientResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&cresp); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Printf("'/client-request' POST response: %+v\n", cresp)
+	return cresp
+}
+
+// testOwnedBackend records whether the backend is shut down.
+type testOwnedBackend struct {
+	Backend
+	shutdown bool
+}
+
+func (b *testOwnedBackend) Shutdown(ctx context.Context) error {
+	b.shutdown = true
+	return b.Backend.Shutdown(ctx)
+}
+
+func TestServer_fake(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	backend := &testOwnedBackend{Backend: NewFakeBackend(3)}
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Backend:               backend,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	if cresp := testClientRequest(t, srv, "", ClientRequest{Action: "write", Member: "node1", KeyValue: KeyValue{Key: "foo", Value: "bar"}}); !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cresp := testClientRequest(t, srv, "", ClientRequest{Action: "get", Endpoints: testEndpoints(t, srv, "node2", false), RangePrefix: true, KeyValue: KeyValue{Key: "fo"}})
+	if !cresp.Success || len(cresp.KeyValues) != 1 || cresp.KeyValues[0].Value != "bar" {
+		t.Fatalf("unexpected 'get' response %+v", cresp)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cresp = testClientRequest(t, srv, "", ClientRequest{Action: "stop-node", Member: "node1"})
+	if !cresp.Success {
+		t.Fatalf("'stop-node' failed (%s)", cresp.Result)
+	}
+	if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+		t.Fatalf("expected %q, got %+v", OperationDone, op)
+	}
+	if n := srv.backend.ActiveNodeN(); n != 2 {
+		t.Fatalf("expected 2 active nodes, got %d", n)
+	}
+	for _, st := range srv.backend.AllMemberStatus() {
+		if st.Name == "node1" && st.State != clusterpb.StoppedMemberStatus {
+			t.Fatalf("expected node1 stopped, got %+v", st)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if cresp = testClientRequest(t, srv, "", ClientRequest{Action: "get", Member: "node1", KeyValue: KeyValue{Key: "foo"}}); cresp.Success {
+		t.Fatalf("expected 'get' failure from stopped node1, got %+v", cresp)
+	}
+
+	// operations of a cluster wait for each other, but not for other clusters,
+	// and the operations of a user are capped
+	blockc := make(chan struct{})
+	block := func(context.Context) (string, error) {
+		<-blockc
+		return "", nil
+	}
+	for i := 0; i < maxUserOperations; i++ {
+		if _, err = srv.operations.submit(backend, "user1", "stop-node", "node2", block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = srv.operations.submit(backend, "user1", "stop-node", "node2", block); err != errTooManyUserOperations {
+		t.Fatalf("expected %v, got %v", errTooManyUserOperations, err)
+	}
+	op, err := srv.operations.submit(NewFakeBackend(1), "user2", "stop-node", "node1", func(context.Context) (string, error) {
+		return "stopped", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wctx, wcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	op, _ = srv.operations.wait(wctx, op.ID, OperationQueued)
+	op, _ = srv.operations.wait(wctx, op.ID, OperationRunning)
+	wcancel()
+	close(blockc)
+	if op.State != OperationDone {
+		t.Fatalf("expected the other cluster's operation %q, got %+v", OperationDone, op)
+	}
+
+	// the given backend is owned by the caller
+	srv.Stop()
+	if backend.shutdown {
+		t.Fatal("expected the given backend not shut down by the server")
+	}
+}
+
+func TestServer_sandbox(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:    fmt.Sprintf("localhost:%d", port),
+		Sandbox: true,
+		NewSandbox: func(context.Context) (Backend, error) {
+			return NewFakeBackend(3), nil
+		},
+		MaxSandboxes:          2,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+		UserCacheInterval:     100 * time.Millisecond,
+		UserInactiveTimeout:   300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// viewing the status does not start a cluster
+	hreq, err := http.NewRequest(http.MethodGet, srv.addrURL.String()+"/server-status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq.Header.Set("X-Forwarded-For", "10.0.0.4")
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ss ServerStatus
+	err = json.NewDecoder(resp.Body).Decode(&ss)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.sandboxMu.Lock()
+	n := len(srv.sandboxes)
+	srv.sandboxMu.Unlock()
+	if n != 0 || ss.PlaygroundActive || len(ss.MemberStatuses) != 0 {
+		t.Fatalf("expected no user cluster started by '/server-status', got %d (%+v)", n, ss)
+	}
+
+	if cresp := testClientRequest(t, srv, "10.0.0.1", ClientRequest{Action: "write", Member: "node1", KeyValue: KeyValue{Key: "foo", Value: "bar"}}); !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cresp := testClientRequest(t, srv, "10.0.0.2", ClientRequest{Action: "get", Member: "node1", KeyValue: KeyValue{Key: "foo"}}); !cresp.Success || len(cresp.KeyValues) != 0 {
+		t.Fatalf("expected no key from the other user's cluster, got %+v", cresp)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cresp := testClientRequest(t, srv, "10.0.0.3", ClientRequest{Action: "get", Member: "node1", KeyValue: KeyValue{Key: "foo"}}); cresp.Success {
+		t.Fatalf("expected %v, got %+v", errTooManySandboxes, cresp)
+	}
+
+	srv.sandboxMu.Lock()
+	n = len(srv.sandboxes)
+	srv.sandboxMu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 user clusters, got %d", n)
+	}
+
+	// writes are rejected while the disk quota is used up
+	srv.sandboxMu.Lock()
+	srv.sandboxDiskBytes = srv.cfg.MaxSandboxDiskBytes
+	srv.sandboxMu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	if cresp := testClientRequest(t, srv, "10.0.0.1", ClientRequest{Action: "write", Member: "node1", KeyValue: KeyValue{Key: "foo", Value: "baz"}}); cresp.Success {
+		t.Fatalf("expected %v, got %+v", errSandboxDiskFull, cresp)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cresp := testClientRequest(t, srv, "10.0.0.1", ClientRequest{Action: "get", Member: "node1", KeyValue: KeyValue{Key: "foo"}}); !cresp.Success || len(cresp.KeyValues) != 1 || cresp.KeyValues[0].Value != "bar" {
+		t.Fatalf("expected 'foo' to be 'bar', got %+v", cresp)
+	}
+	srv.sandboxMu.Lock()
+	srv.sandboxDiskBytes = 0
+	srv.sandboxMu.Unlock()
+
+	// inactive users expire, and their clusters are reclaimed
+	time.Sleep(time.Second)
+	srv.sandboxMu.Lock()
+	n = len(srv.sandboxes)
+	srv.sandboxMu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected user clusters reclaimed, got %d", n)
+	}
+}
+
+func TestServer_namespace(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Backend:               NewFakeBackend(3),
+		Namespace:             true,
+		ClientRequestInterval: time.Millisecond,
+		UserCacheInterval:     100 * time.Millisecond,
+		UserInactiveTimeout:   300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if cresp := testClientRequest(t, srv, ip, ClientRequest{Action: "write", Member: "node1", KeyValue: KeyValue{Key: "foo", Value: ip}}); !cresp.Success {
+			t.Fatalf("'write' failed (%s)", cresp.Result)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cresp := testClientRequest(t, srv, "10.0.0.1", ClientRequest{Action: "get", Member: "node2", RangePrefix: true, KeyValue: KeyValue{Key: "f"}})
+	if !cresp.Success || !reflect.DeepEqual(testKeyValuePairs(cresp.KeyValues), []KeyValue{{Key: "foo", Value: "10.0.0.1"}}) {
+		t.Fatalf("expected only the user's key, got %+v", cresp)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cresp = testClientRequest(t, srv, "10.0.0.2", ClientRequest{Action: "delete", Member: "node2", RangePrefix: true, KeyValue: KeyValue{Key: "f"}})
+	if !cresp.Success || !reflect.DeepEqual(testKeyValuePairs(cresp.KeyValues), []KeyValue{{Key: "foo", Value: "10.0.0.2"}}) {
+		t.Fatalf("expected only the user's key deleted, got %+v", cresp)
+	}
+
+	kv, err := srv.backend.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gresp, err := kv.Get(context.Background(), "/etcdlabs/users/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gresp.Kvs) != 1 {
+		t.Fatalf("expected 1 key left, got %+v", gresp.Kvs)
+	}
+
+	// keys are deleted when the user expires
+	time.Sleep(time.Second)
+	gresp, err = kv.Get(context.Background(), "/etcdlabs/users/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gresp.Kvs) != 0 {
+		t.Fatalf("expected keys of expired users deleted, got %+v", gresp.Kvs)
+	}
+	srv.namespaceMu.Lock()
+	n := len(srv.namespaceUsers)
+	srv.namespaceMu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected expired users forgotten after their keys are deleted, got %d", n)
+	}
+}
+
+func TestServer_sharedRateLimit(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort += 3
+	testMu.Unlock()
+
+	// the cluster of the first server stores the rate limit state
+	srv, err := StartServer(ServerConfig{
+		Addr:    fmt.Sprintf("localhost:%d", port),
+		Cluster: cluster.Config{Size: 1, EmbeddedClient: true, RootPort: testClusterPort()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	clus := srv.backend.(*embeddedBackend).clus
+	cli, err := clus.PooledClient(clus.Members[0].Endpoints(false)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replicas behind a load balancer
+	var replicas []*Server
+	for i := 1; i <= 2; i++ {
+		rsrv, err := StartServer(ServerConfig{
+			Addr:            fmt.Sprintf("localhost:%d", port+i),
+			Backend:         NewFakeBackend(1),
+			RateLimitClient: cli,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsrv.Stop()
+		replicas = append(replicas, rsrv)
+	}
+
+	req := ClientRequest{Action: "write", Member: "node1", KeyValue: KeyValue{Key: "foo", Value: "bar"}}
+	if cresp := testClientRequest(t, replicas[0], "10.0.0.1", req); !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+	cresp := testClientRequest(t, replicas[1], "10.0.0.1", req)
+	if cresp.Success || !strings.Contains(cresp.Result, "rate limit exceeded") {
+		t.Fatalf("expected the other replica to be rate limited, got %+v", cresp)
+	}
+	if cresp = testClientRequest(t, replicas[1], "10.0.0.2", req); !cresp.Success {
+		t.Fatalf("'write' of another user failed (%s)", cresp.Result)
+	}
+}
+
+func TestServer_rateLimitPolicies(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:    fmt.Sprintf("localhost:%d", port),
+		Backend: NewFakeBackend(1),
+		RateLimitPolicies: []RateLimitPolicy{
+			{Routes: []string{"/client-request"}, Interval: time.Hour, Burst: 2},
+			{Actions: []string{"write"}, Interval: time.Hour},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	post := func(act string) (*http.Response, ClientResponse) {
+		data, err := json.Marshal(ClientRequest{Action: act, Member: "node1", KeyValue: KeyValue{Key: "foo", Value: "bar"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(srv.addrURL.String()+"/client-request", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		cresp := ClientResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&cresp); err != nil {
+			t.Fatal(err)
+		}
+		return resp, cresp
+	}
+
+	// the stricter 'write' policy is reported
+	resp, cresp := post("write")
+	if resp.StatusCode != http.StatusOK || !cresp.Success {
+		t.Fatalf("expected 'write' success, got %d %+v", resp.StatusCode, cresp)
+	}
+	if l, r := resp.Header.Get("X-RateLimit-Limit"), resp.Header.Get("X-RateLimit-Remaining"); l != "1" || r != "0" {
+		t.Fatalf("expected limit 1 and remaining 0, got %q and %q", l, r)
+	}
+	if reset := resp.Header.Get("X-RateLimit-Reset"); reset != "3600" {
+		t.Fatalf("expected reset 3600, got %q", reset)
+	}
+
+	resp, cresp = post("write")
+	if resp.StatusCode != http.StatusTooManyRequests || cresp.Success || !strings.HasPrefix(cresp.Result, "'write' request rate limit exceeded") {
+		t.Fatalf("expected 'write' rate-limit excess, got %d %+v", resp.StatusCode, cresp)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "3600" {
+		t.Fatalf("expected Retry-After 3600, got %q", ra)
+	}
+
+	resp, cresp = post("get")
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.HasPrefix(cresp.Result, "client request rate limit exceeded") {
+		t.Fatalf("expected client request rate-limit excess, got %d %+v", resp.StatusCode, cresp)
+	}
+
+	mresp, err := http.Get(srv.addrURL.String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mresp.Body.Close()
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(mresp.Body); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`etcdlabs_ratelimit_rejected_total{policy="/client-request"} 1`,
+		`etcdlabs_ratelimit_rejected_total{policy="write"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("expected %q in metrics, got\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestServer_statusStream(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Backend:               NewFakeBackend(3),
+		StatusInterval:        50 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	if srv.statusWanted() {
+		t.Fatal("expected no status reader")
+	}
+
+	resp, err := http.Get(srv.addrURL.String() + "/server-status-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %q", ct)
+	}
+	if !srv.statusWanted() {
+		t.Fatal("expected the subscriber to read statuses")
+	}
+
+	type event struct{ name, data string }
+	eventc := make(chan event, 100)
+	go func() {
+		defer close(eventc)
+		var ev event
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && ev.name != "":
+				eventc <- ev
+				ev = event{}
+			}
+		}
+	}()
+	waitEvent := func(name string, match func(data string) bool) string {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case ev, ok := <-eventc:
+				if !ok {
+					t.Fatalf("stream closed before %q", name)
+				}
+				if ev.name == name && match(ev.data) {
+					return ev.data
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for %q", name)
+			}
+		}
+	}
+
+	data := waitEvent("status", func(string) bool { return true })
+	var st ServerStatus
+	if err = json.Unmarshal([]byte(data), &st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.MemberStatuses) != 3 {
+		t.Fatalf("expected 3 member statuses, got %+v", st)
+	}
+
+	if cresp := testClientRequest(t, srv, "", ClientRequest{Action: "stop-node", Member: "node2"}); !cresp.Success {
+		t.Fatalf("'stop-node' failed (%s)", cresp.Result)
+	}
+	data = waitEvent("status-diff", func(data string) bool { return strings.Contains(data, `"Name":"node2"`) })
+	var diff ServerStatusDiff
+	if err = json.Unmarshal([]byte(data), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.MemberStatuses) == 0 || diff.MemberStatuses[0].State != clusterpb.StoppedMemberStatus {
+		t.Fatalf("expected stopped node2, got %+v", diff)
+	}
+	data = waitEvent("cluster", func(data string) bool { return strings.Contains(data, "member-stopped") })
+	var ev ClusterEvent
+	if err = json.Unmarshal([]byte(data), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Member != "node2" {
+		t.Fatalf("expected event of node2, got %+v", ev)
+	}
+
+	// the humanized times alone are not changes
+	prev := ServerStatus{
+		ServerUptime:   "1 second ago",
+		MemberStatuses: []clusterpb.MemberStatus{{Name: "node1", StateTxt: "node1 has been healthy (since 1 second ago)"}},
+	}
+	cur := ServerStatus{
+		ServerUptime:   "2 seconds ago",
+		MemberStatuses: []clusterpb.MemberStatus{{Name: "node1", StateTxt: "node1 has been healthy (since 2 seconds ago)"}},
+	}
+	if diff, changed := diffServerStatus(prev, cur); changed {
+		t.Fatalf("expected no change, got %+v", diff)
+	}
+}
+
+func TestServer_watch(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 3, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	cresp := testClientRequest(t, srv, "", ClientRequest{Action: "watch", Member: "node1", RangePrefix: true, KeyValue: KeyValue{Key: "foo"}})
+	if !cresp.Success || cresp.WatchID == "" {
+		t.Fatalf("'watch' failed (%s)", cresp.Result)
+	}
+	if _, ok := srv.userWatch("other", cresp.WatchID); ok {
+		t.Fatal("expected the watch to be hidden from other users")
+	}
+
+	resp, err := http.Get(srv.addrURL.String() + "/watch?id=" + cresp.WatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %q", ct)
+	}
+
+	type event struct{ name, data string }
+	eventc := make(chan event, 100)
+	go func() {
+		defer close(eventc)
+		var ev event
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && ev.name != "":
+				eventc <- ev
+				ev = event{}
+			}
+		}
+	}()
+	waitEvent := func(match func(ev WatchEvent) bool) WatchEvent {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case ev, ok := <-eventc:
+				if !ok {
+					t.Fatal("stream closed before the event")
+				}
+				var wev WatchEvent
+				if err := json.Unmarshal([]byte(ev.data), &wev); err != nil {
+					t.Fatal(err)
+				}
+				if ev.name == "watch" && match(wev) {
+					return wev
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for the event")
+			}
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if cresp = testClientRequest(t, srv, "", ClientRequest{Action: "write", Member: "node2", KeyValue: KeyValue{Key: "foo1", Value: "bar1"}}); !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+	wev := waitEvent(func(ev WatchEvent) bool { return ev.Type == "PUT" })
+	if wev.Key != "foo1" || wev.Value != "bar1" || wev.Revision == 0 {
+		t.Fatalf("unexpected event %+v", wev)
+	}
+
+	// the watch moves to other members when its member stops
+	time.Sleep(10 * time.Millisecond)
+	cresp = testClientRequest(t, srv, "", ClientRequest{Action: "stop-node", Member: "node1"})
+	if !cresp.Success {
+		t.Fatalf("'stop-node' failed (%s)", cresp.Result)
+	}
+	if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+		t.Fatalf("'stop-node' failed (%+v)", op)
+	}
+	waitEvent(func(ev WatchEvent) bool { return ev.Type == "RECONNECT" })
+
+	time.Sleep(10 * time.Millisecond)
+	if cresp = testClientRequest(t, srv, "", ClientRequest{Action: "write", Member: "node2", KeyValue: KeyValue{Key: "foo1", Value: "bar2"}}); !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+	wev = waitEvent(func(ev WatchEvent) bool { return ev.Type == "PUT" })
+	if wev.Value != "bar2" || wev.PrevKV == nil || wev.PrevKV.Value != "bar1" {
+		t.Fatalf("unexpected event %+v", wev)
+	}
+
+	// the watch is canceled when the user leaves
+	req, err := http.NewRequest(http.MethodDelete, srv.addrURL.String()+"/conn", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dresp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dresp.Body.Close()
+	timeout := time.After(10 * time.Second)
+	for ev := range eventc {
+		if ev.name == "watch-end" {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatal("timed out waiting for the end of the watch")
+		default:
+		}
+	}
+	t.Fatal("stream closed before the end of the watch")
+}
+
+func TestServer_txn(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 1, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	if cresp := testClientRequest(t, srv, "", ClientRequest{Action: "write", Member: "node1", KeyValue: KeyValue{Key: "foo", Value: "bar"}}); !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+
+	// compare-and-swap succeeds only once
+	cas := &TxnRequest{
+		Compares: []TxnCompare{{Key: "foo", Target: "value", Result: "=", Value: "bar"}},
+		Then:     []TxnOp{{Type: "put", KeyValue: KeyValue{Key: "foo", Value: "baz"}}},
+		Else:     []TxnOp{{Type: "get", RangePrefix: true, KeyValue: KeyValue{Key: "fo"}}},
+	}
+	tests := []struct {
+		branch string
+		resps  []TxnOpResponse
+	}{
+		{"then", []TxnOpResponse{{Op: cas.Then[0]}}},
+		{"else", []TxnOpResponse{{Op: cas.Else[0], KeyValues: []KeyValue{{Key: "foo", Value: "baz"}}}}},
+	}
+	for i, tt := range tests {
+		time.Sleep(10 * time.Millisecond)
+		cresp := testClientRequest(t, srv, "", ClientRequest{Action: "txn", Member: "node1", Txn: cas})
+		if !cresp.Success || cresp.TxnBranch != tt.branch {
+			t.Fatalf("#%d: expected '%s' branch, got %+v", i, tt.branch, cresp)
+		}
+		for j := range cresp.TxnResponses {
+			cresp.TxnResponses[j].KeyValues = testKeyValuePairs(cresp.TxnResponses[j].KeyValues)
+		}
+		if !reflect.DeepEqual(cresp.TxnResponses, tt.resps) {
+			t.Fatalf("#%d: expected responses %+v, got %+v", i, tt.resps, cresp.TxnResponses)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cresp := testClientRequest(t, srv, "", ClientRequest{Action: "txn", Member: "node1", Txn: &TxnRequest{
+		Compares: []TxnCompare{{Key: "foo", Target: "mod", Result: ">", Value: "one"}},
+	}})
+	if cresp.Success || !strings.Contains(cresp.Result, "non-numeric") {
+		t.Fatalf("expected the malformed compare rejected, got %+v", cresp)
+	}
+}
+
+func TestServer_lease(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 3, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	srv.backend.UpdateMemberStatus(ctx)
+	cancel()
+	var leader, follower string
+	for _, st := range srv.backend.AllMemberStatus() {
+		if st.IsLeader {
+			leader = st.Name
+		} else {
+			follower = st.Name
+		}
+	}
+	if leader == "" {
+		t.Fatal("no leader")
+	}
+
+	request := func(ip string, req ClientRequest) ClientResponse {
+		time.Sleep(10 * time.Millisecond)
+		return testClientRequest(t, srv, ip, req)
+	}
+	get := func(key string) []KeyValue {
+		cresp := request("", ClientRequest{Action: "get", Member: follower, KeyValue: KeyValue{Key: key}})
+		if !cresp.Success {
+			t.Fatalf("'get' failed (%s)", cresp.Result)
+		}
+		return cresp.KeyValues
+	}
+
+	// 'write' with TTL grants a lease
+	short := request("", ClientRequest{Action: "write", Member: follower, TTL: 2, KeyValue: KeyValue{Key: "short", Value: "bar"}})
+	if !short.Success || short.LeaseID == "" {
+		t.Fatalf("'write' with TTL failed (%+v)", short)
+	}
+
+	long := request("", ClientRequest{Action: "lease-grant", Member: follower, TTL: 2})
+	if !long.Success || long.LeaseID == "" {
+		t.Fatalf("'lease-grant' failed (%+v)", long)
+	}
+	if cresp := request("", ClientRequest{Action: "write", Member: follower, LeaseID: long.LeaseID, KeyValue: KeyValue{Key: "long", Value: "bar"}}); !cresp.Success {
+		t.Fatalf("'write' with lease failed (%s)", cresp.Result)
+	}
+	if cresp := request("10.0.0.9", ClientRequest{Action: "write", Member: follower, LeaseID: long.LeaseID, KeyValue: KeyValue{Key: "other", Value: "bar"}}); cresp.Success {
+		t.Fatalf("expected the lease of another user rejected, got %+v", cresp)
+	}
+
+	// keep-alive through the leader moves to other members when it stops
+	if cresp := request("", ClientRequest{Action: "lease-keepalive", Member: leader, LeaseID: long.LeaseID, KeepAlive: 6}); !cresp.Success {
+		t.Fatalf("'lease-keepalive' failed (%s)", cresp.Result)
+	}
+	cresp := request("", ClientRequest{Action: "stop-node", Member: leader})
+	if !cresp.Success {
+		t.Fatalf("'stop-node' failed (%s)", cresp.Result)
+	}
+	if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+		t.Fatalf("'stop-node' failed (%+v)", op)
+	}
+	time.Sleep(3 * time.Second)
+
+	cresp = request("", ClientRequest{Action: "lease-list", Member: follower})
+	if !cresp.Success {
+		t.Fatalf("'lease-list' failed (%s)", cresp.Result)
+	}
+	var found bool
+	for _, l := range cresp.Leases {
+		if l.ID != long.LeaseID {
+			continue
+		}
+		found = true
+		if l.TTL <= 0 || !l.KeepAlive || !reflect.DeepEqual(l.Keys, []string{"long"}) {
+			t.Fatalf("expected the lease kept alive across the leader change, got %+v", l)
+		}
+	}
+	if !found {
+		t.Fatalf("lease %s not listed (%+v)", long.LeaseID, cresp.Leases)
+	}
+	if kvs := get("long"); len(kvs) != 1 {
+		t.Fatalf("expected the key of the kept-alive lease, got %+v", kvs)
+	}
+
+	// keys are deleted when the leases expire, after the keep-alive ends
+	for _, key := range []string{"short", "long"} {
+		deadline := time.Now().Add(15 * time.Second)
+		for len(get(key)) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q deleted when its lease expires", key)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+	}
+
+	// expired leases are forgotten, so that they do not count to the limit
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.cancelLeases(func(string) bool { return true })
+		srv.leaseMu.Lock()
+		n := len(srv.leases)
+		srv.leaseMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected expired leases forgotten, got %d leases", n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	revoked := request("", ClientRequest{Action: "write", Member: follower, TTL: 60, KeyValue: KeyValue{Key: "revoked", Value: "bar"}})
+	if !revoked.Success {
+		t.Fatalf("'write' with TTL failed (%s)", revoked.Result)
+	}
+	if cresp = request("", ClientRequest{Action: "lease-revoke", Member: follower, LeaseID: revoked.LeaseID}); !cresp.Success {
+		t.Fatalf("'lease-revoke' failed (%s)", cresp.Result)
+	}
+	if kvs := get("revoked"); len(kvs) != 0 {
+		t.Fatalf("expected the key of the revoked lease deleted, got %+v", kvs)
+	}
+
+	// concurrent grants do not exceed the limit
+	errc := make(chan error, maxUserLeases+5)
+	for i := 0; i < cap(errc); i++ {
+		go func() {
+			_, err := srv.grantLease(context.Background(), srv.backend, "concurrent", 60)
+			errc <- err
+		}()
+	}
+	granted := 0
+	for i := 0; i < cap(errc); i++ {
+		switch err := <-errc; err {
+		case nil:
+			granted++
+		case errTooManyLeases:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if granted != maxUserLeases {
+		t.Fatalf("expected %d leases granted, got %d", maxUserLeases, granted)
+	}
+}
+
+func TestServer_range(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 1, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	request := func(req ClientRequest) ClientResponse {
+		time.Sleep(10 * time.Millisecond)
+		req.Member = "node1"
+		cresp := testClientRequest(t, srv, "", req)
+		if !cresp.Success {
+			t.Fatalf("%q failed (%s)", req.Action, cresp.Result)
+		}
+		return cresp
+	}
+	var revs []int64
+	for _, kv := range []KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "b", Value: "3"}} {
+		revs = append(revs, request(ClientRequest{Action: "write", KeyValue: kv}).Revision)
+	}
+	leased := request(ClientRequest{Action: "write", TTL: 60, KeyValue: KeyValue{Key: "c", Value: "4"}})
+
+	cresp := request(ClientRequest{Action: "get", RangePrefix: true})
+	if cresp.Revision != leased.Revision || cresp.RaftTerm == 0 || cresp.Count != 3 || len(cresp.KeyValues) != 3 {
+		t.Fatalf("expected all 3 keys at revision %d, got %+v", leased.Revision, cresp)
+	}
+	b := cresp.KeyValues[1]
+	if b.Key != "b" || b.CreateRevision != revs[1] || b.ModRevision != revs[2] || b.Version != 2 {
+		t.Fatalf("unexpected metadata of 'b' %+v", b)
+	}
+	if c := cresp.KeyValues[2]; c.Lease != leased.LeaseID {
+		t.Fatalf("expected lease %s of 'c', got %+v", leased.LeaseID, c)
+	}
+
+	tests := []struct {
+		req   ClientRequest
+		pairs []KeyValue
+		count int64
+		more  bool
+	}{
+		{
+			ClientRequest{Action: "get", RangeEnd: "c", KeyValue: KeyValue{Key: "a"}},
+			[]KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "3"}}, 2, false,
+		},
+		{
+			ClientRequest{Action: "get", RangeEnd: allKeysFrom, KeyValue: KeyValue{Key: "b"}},
+			[]KeyValue{{Key: "b", Value: "3"}, {Key: "c", Value: "4"}}, 2, false,
+		},
+		{
+			ClientRequest{Action: "get", RangePrefix: true, Limit: 1, SortOrder: "descend"},
+			[]KeyValue{{Key: "c", Value: "4"}}, 3, true,
+		},
+		{
+			ClientRequest{Action: "get", RangePrefix: true, SortTarget: "mod", SortOrder: "descend", KeysOnly: true},
+			[]KeyValue{{Key: "c"}, {Key: "b"}, {Key: "a"}}, 3, false,
+		},
+		{
+			ClientRequest{Action: "get", RangePrefix: true, CountOnly: true},
+			nil, 3, false,
+		},
+		{
+			ClientRequest{Action: "get", Revision: revs[1], KeyValue: KeyValue{Key: "b"}},
+			[]KeyValue{{Key: "b", Value: "2"}}, 1, false,
+		},
+	}
+	for i, tt := range tests {
+		cresp = request(tt.req)
+		if pairs := testKeyValuePairs(cresp.KeyValues); !reflect.DeepEqual(pairs, tt.pairs) && len(pairs)+len(tt.pairs) > 0 {
+			t.Fatalf("#%d: expected %+v, got %+v", i, tt.pairs, pairs)
+		}
+		if cresp.Count != tt.count || cresp.More != tt.more {
+			t.Fatalf("#%d: expected count %d (more %v), got %d (more %v)", i, tt.count, tt.more, cresp.Count, cresp.More)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cresp = testClientRequest(t, srv, "", ClientRequest{Action: "get", Member: "node1", RangePrefix: true, SortTarget: "size"})
+	if cresp.Success || !strings.Contains(cresp.Result, "unknown sort target") {
+		t.Fatalf("expected the unknown sort target rejected, got %+v", cresp)
+	}
+}
+
+func TestServer_history(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 1, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	request := func(req ClientRequest) ClientResponse {
+		time.Sleep(10 * time.Millisecond)
+		req.Member = "node1"
+		cresp := testClientRequest(t, srv, "", req)
+		if !cresp.Success {
+			t.Fatalf("%q failed (%s)", req.Action, cresp.Result)
+		}
+		return cresp
+	}
+	var revs []int64
+	for _, req := range []ClientRequest{
+		{Action: "write", KeyValue: KeyValue{Key: "foo", Value: "1"}},
+		{Action: "write", KeyValue: KeyValue{Key: "foo", Value: "2"}},
+		{Action: "delete", KeyValue: KeyValue{Key: "foo"}},
+		{Action: "write", KeyValue: KeyValue{Key: "foo", Value: "3"}},
+		{Action: "write", KeyValue: KeyValue{Key: "bar", Value: "4"}},
+	} {
+		revs = append(revs, request(req).Revision)
+	}
+
+	type change struct {
+		typ, value string
+		rev        int64
+	}
+	changes := func(evs []WatchEvent) (cs []change) {
+		for _, ev := range evs {
+			cs = append(cs, change{ev.Type, ev.Value, ev.Revision})
+		}
+		return cs
+	}
+
+	cresp := request(ClientRequest{Action: "history", KeyValue: KeyValue{Key: "foo"}})
+	expected := []change{{"PUT", "1", revs[0]}, {"PUT", "2", revs[1]}, {"DELETE", "", revs[2]}, {"PUT", "3", revs[3]}}
+	if !reflect.DeepEqual(changes(cresp.Events), expected) || cresp.CompactRevision != 0 {
+		t.Fatalf("expected %+v, got %+v", expected, cresp)
+	}
+	if prev := cresp.Events[2].PrevKV; prev == nil || prev.Value != "2" {
+		t.Fatalf("expected the deleted value in %+v", cresp.Events[2])
+	}
+
+	cresp = request(ClientRequest{Action: "history", RangePrefix: true, StartRevision: revs[1], EndRevision: revs[2]})
+	if expected = expected[1:3]; !reflect.DeepEqual(changes(cresp.Events), expected) {
+		t.Fatalf("expected %+v, got %+v", expected, changes(cresp.Events))
+	}
+
+	// compacted history is marked, and skipped
+	kv, err := srv.backend.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kv.Compact(context.Background(), revs[1]); err != nil {
+		t.Fatal(err)
+	}
+	cresp = request(ClientRequest{Action: "history", KeyValue: KeyValue{Key: "foo"}})
+	expected = []change{{"PUT", "2", revs[1]}, {"DELETE", "", revs[2]}, {"PUT", "3", revs[3]}}
+	if !reflect.DeepEqual(changes(cresp.Events), expected) || cresp.CompactRevision != revs[1] {
+		t.Fatalf("expected %+v compacted at %d, got %+v", expected, revs[1], cresp)
+	}
+}
+
+func TestServer_serializable(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 3, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	request := func(req ClientRequest) ClientResponse {
+		time.Sleep(10 * time.Millisecond)
+		return testClientRequest(t, srv, "", req)
+	}
+	node1, err := srv.backend.Member("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cresp := request(ClientRequest{Action: "write", Member: "node2", KeyValue: KeyValue{Key: "foo", Value: "bar"}}); !cresp.Success || cresp.MemberName != "node2" {
+		t.Fatalf("expected 'write' served by node2, got %+v", cresp)
+	}
+	for _, serializable := range []bool{false, true} {
+		cresp := request(ClientRequest{Action: "get", Member: "node1", Serializable: serializable, KeyValue: KeyValue{Key: "foo"}})
+		if !cresp.Success || len(cresp.KeyValues) != 1 {
+			t.Fatalf("'get' failed (%+v)", cresp)
+		}
+		if cresp.MemberID != node1.ID || cresp.MemberName != "node1" || cresp.RaftTerm == 0 {
+			t.Fatalf("expected 'get' served by node1 (%s), got %+v", node1.ID, cresp)
+		}
+	}
+
+	// node1 loses quorum, but still serves serializable reads
+	for _, name := range []string{"node2", "node3"} {
+		cresp := request(ClientRequest{Action: "stop-node", Member: name})
+		if !cresp.Success {
+			t.Fatalf("'stop-node' failed (%s)", cresp.Result)
+		}
+		if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+			t.Fatalf("'stop-node' failed (%+v)", op)
+		}
+	}
+	cresp := request(ClientRequest{Action: "get", Member: "node1", Serializable: true, KeyValue: KeyValue{Key: "foo"}})
+	if !cresp.Success || !reflect.DeepEqual(testKeyValuePairs(cresp.KeyValues), []KeyValue{{Key: "foo", Value: "bar"}}) || cresp.MemberName != "node1" {
+		t.Fatalf("expected serializable 'get' served by node1, got %+v", cresp)
+	}
+	if cresp = request(ClientRequest{Action: "get", Member: "node1", KeyValue: KeyValue{Key: "foo"}}); cresp.Success {
+		t.Fatalf("expected linearizable 'get' failed without quorum, got %+v", cresp)
+	}
+}
+
+func TestServer_balanced(t *testing.T) {
+	testMu.Lock()
+	port := testBasePort
+	testBasePort++
+	testMu.Unlock()
+
+	srv, err := StartServer(ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", port),
+		Cluster:               cluster.Config{Size: 3, EmbeddedClient: true, RootPort: testClusterPort()},
+		Namespace:             true,
+		StatusInterval:        100 * time.Millisecond,
+		ClientRequestInterval: time.Millisecond,
+		StopRestartInterval:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	var eps []string
+	for _, name := range []string{"node1", "node2", "node3"} {
+		eps = append(eps, testEndpoints(t, srv, name, false)[0])
+	}
+	request := func(req ClientRequest) ClientResponse {
+		time.Sleep(10 * time.Millisecond)
+		req.Endpoints, req.Balanced = eps, true
+		return testClientRequest(t, srv, "", req)
+	}
+
+	cresp := request(ClientRequest{Action: "write", KeyValue: KeyValue{Key: "foo", Value: "bar"}})
+	if !cresp.Success {
+		t.Fatalf("'write' failed (%s)", cresp.Result)
+	}
+	served := cresp.MemberName
+	if served == "" || endpointHost(cresp.Endpoint) != endpointHost(testEndpoints(t, srv, served, false)[0]) {
+		t.Fatalf("expected the serving member and endpoint, got %+v", cresp)
+	}
+
+	// requests fail over to the other endpoints when the serving member stops
+	if cresp = testClientRequest(t, srv, "", ClientRequest{Action: "stop-node", Member: served}); !cresp.Success {
+		t.Fatalf("'stop-node' failed (%s)", cresp.Result)
+	}
+	if op := testWaitOperation(t, srv, cresp.OperationID); op.State != OperationDone {
+		t.Fatalf("'stop-node' failed (%+v)", op)
+	}
+	for i := 0; i < 5; i++ {
+		cresp = request(ClientRequest{Action: "get", KeyValue: KeyValue{Key: "foo"}})
+		if !cresp.Success || !reflect.DeepEqual(testKeyValuePairs(cresp.KeyValues), []KeyValue{{Key: "foo", Value: "bar"}}) {
+			t.Fatalf("expected 'get' failed over from %s, got %+v", served, cresp)
+		}
+		if cresp.MemberName == served || cresp.MemberName == "" {
+			t.Fatalf("expected 'get' served by a running member, got %+v", cresp)
+		}
+	}
 }
@@ -0,0 +1,288 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster/clusterpb"
+)
+
+var (
+	// statusPollWindow is the number of status intervals to keep updating
+	// member statuses after a '/server-status' poll.
+	statusPollWindow = 3
+
+	// statusStreamPingInterval is the interval of keep-alive comments
+	// on idle '/server-status-stream' connections.
+	statusStreamPingInterval = 15 * time.Second
+)
+
+// statusWanted returns true if member statuses have any reader:
+// a '/server-status-stream' subscriber, or a recent '/server-status' poll.
+func (srv *Server) statusWanted() bool {
+	srv.statusMu.Lock()
+	defer srv.statusMu.Unlock()
+	if len(srv.statusSubs) > 0 {
+		return true
+	}
+	return time.Since(srv.statusPolled) < time.Duration(statusPollWindow)*srv.cfg.StatusInterval
+}
+
+// kickStatus wakes up 'updateClusterStatus', so that a new reader
+// does not wait for the next interval.
+func (srv *Server) kickStatus() {
+	select {
+	case srv.statusKickc <- struct{}{}:
+	default:
+	}
+}
+
+// pollStatus records a '/server-status' poll.
+func (srv *Server) pollStatus() {
+	wanted := srv.statusWanted()
+	srv.statusMu.Lock()
+	srv.statusPolled = time.Now()
+	srv.statusMu.Unlock()
+	if !wanted {
+		srv.kickStatus()
+	}
+}
+
+// subscribeStatus returns the channel signaled on every status update.
+func (srv *Server) subscribeStatus() chan struct{} {
+	ch := make(chan struct{}, 1)
+	srv.statusMu.Lock()
+	srv.statusSubs[ch] = struct{}{}
+	srv.statusMu.Unlock()
+	srv.kickStatus()
+	return ch
+}
+
+func (srv *Server) unsubscribeStatus(ch chan struct{}) {
+	srv.statusMu.Lock()
+	delete(srv.statusSubs, ch)
+	srv.statusMu.Unlock()
+}
+
+// notifyStatus signals the subscribers without blocking; a subscriber
+// behind by several updates only sees the latest.
+func (srv *Server) notifyStatus() {
+	srv.statusMu.Lock()
+	defer srv.statusMu.Unlock()
+	for ch := range srv.statusSubs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServerStatusDiff is the change of ServerStatus pushed by
+// '/server-status-stream'. Unchanged fields are omitted.
+type ServerStatusDiff struct {
+	PlaygroundActive *bool     `json:",omitempty"`
+	ServerUptime     *string   `json:",omitempty"`
+	ServerVisits     *uint64   `json:",omitempty"`
+	UserN            *int      `json:",omitempty"`
+	Users            *[]string `json:",omitempty"`
+
+	// MemberStatuses are the changed or added member statuses.
+	MemberStatuses []clusterpb.MemberStatus `json:",omitempty"`
+	// RemovedMembers are the names of the removed members.
+	RemovedMembers []string `json:",omitempty"`
+}
+
+// diffServerStatus returns the change from prev to cur, and false if none.
+// The humanized time texts (e.g. "3 seconds ago") of the uptime and the
+// member states are not compared, since they change on every update;
+// they are refreshed with the other changes.
+func diffServerStatus(prev, cur ServerStatus) (diff ServerStatusDiff, changed bool) {
+	if prev.PlaygroundActive != cur.PlaygroundActive {
+		diff.PlaygroundActive, changed = &cur.PlaygroundActive, true
+	}
+	if prev.ServerVisits != cur.ServerVisits {
+		diff.ServerVisits, changed = &cur.ServerVisits, true
+	}
+	if prev.UserN != cur.UserN {
+		diff.UserN, changed = &cur.UserN, true
+	}
+	if !equalStrings(prev.Users, cur.Users) {
+		diff.Users, changed = &cur.Users, true
+	}
+
+	prevByName := make(map[string]clusterpb.MemberStatus, len(prev.MemberStatuses))
+	for _, st := range prev.MemberStatuses {
+		prevByName[st.Name] = st
+	}
+	for _, st := range cur.MemberStatuses {
+		if pst, ok := prevByName[st.Name]; !ok || !equalMemberStatus(pst, st) {
+			diff.MemberStatuses, changed = append(diff.MemberStatuses, st), true
+		}
+		delete(prevByName, st.Name)
+	}
+	for _, st := range prev.MemberStatuses {
+		if _, ok := prevByName[st.Name]; ok {
+			diff.RemovedMembers, changed = append(diff.RemovedMembers, st.Name), true
+		}
+	}
+	if changed && prev.ServerUptime != cur.ServerUptime {
+		diff.ServerUptime = &cur.ServerUptime
+	}
+	return diff, changed
+}
+
+// equalMemberStatus compares the member statuses except 'StateTxt',
+// which has the humanized time of the state.
+func equalMemberStatus(a, b clusterpb.MemberStatus) bool {
+	a.StateTxt, b.StateTxt = "", ""
+	return a == b
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ClusterEvent is a change of the cluster pushed by '/server-status-stream'.
+// Encode without json tags to make it parsable by Typescript.
+type ClusterEvent struct {
+	// Type is 'leader-changed', 'member-stopped', 'member-started',
+	// 'member-replaced', 'member-added' or 'member-removed'.
+	Type    string
+	Member  string
+	Message string
+}
+
+// clusterEvents returns the events between the member statuses.
+func clusterEvents(prev, cur []clusterpb.MemberStatus) (evs []ClusterEvent) {
+	prevByName := make(map[string]clusterpb.MemberStatus, len(prev))
+	for _, st := range prev {
+		prevByName[st.Name] = st
+	}
+	curNames := make(map[string]bool, len(cur))
+	for _, st := range cur {
+		curNames[st.Name] = true
+		pst, ok := prevByName[st.Name]
+		switch {
+		case !ok:
+			evs = append(evs, ClusterEvent{Type: "member-added", Member: st.Name, Message: fmt.Sprintf("%s was added", st.Name)})
+			continue
+		case pst.ID != st.ID:
+			evs = append(evs, ClusterEvent{Type: "member-replaced", Member: st.Name, Message: fmt.Sprintf("%s was replaced (old ID %s, new ID %s)", st.Name, pst.ID, st.ID)})
+		case pst.State != clusterpb.StoppedMemberStatus && st.State == clusterpb.StoppedMemberStatus:
+			evs = append(evs, ClusterEvent{Type: "member-stopped", Member: st.Name, Message: fmt.Sprintf("%s stopped", st.Name)})
+		case pst.State == clusterpb.StoppedMemberStatus && st.State != clusterpb.StoppedMemberStatus:
+			evs = append(evs, ClusterEvent{Type: "member-started", Member: st.Name, Message: fmt.Sprintf("%s started", st.Name)})
+		}
+		if st.IsLeader && !pst.IsLeader {
+			evs = append(evs, ClusterEvent{Type: "leader-changed", Member: st.Name, Message: fmt.Sprintf("%s became the leader", st.Name)})
+		}
+	}
+	for _, st := range prev {
+		if !curNames[st.Name] {
+			evs = append(evs, ClusterEvent{Type: "member-removed", Member: st.Name, Message: fmt.Sprintf("%s was removed", st.Name)})
+		}
+	}
+	return evs
+}
+
+// serverStatusStreamHandler pushes the server status of the user as
+// Server-Sent Events: 'status' with the full ServerStatus on connect,
+// then 'status-diff' with ServerStatusDiff and 'cluster' with ClusterEvent
+// on every change. Member statuses are updated while anyone is subscribed.
+func (srv *Server) serverStatusStreamHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", 405)
+		return nil
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return nil
+	}
+	userID := *ctx.Value(userKey).(*string)
+
+	notifyc := srv.subscribeStatus()
+	defer srv.unsubscribeStatus(notifyc)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no") // for nginx
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	prev := srv.serverStatus(userID)
+	if err := send("status", prev); err != nil {
+		return err
+	}
+	lastSent := time.Now()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil
+		case <-srv.stopc:
+			return nil
+		case <-notifyc:
+		}
+
+		cur := srv.serverStatus(userID)
+		if diff, changed := diffServerStatus(prev, cur); changed {
+			if err := send("status-diff", diff); err != nil {
+				return err
+			}
+			for _, ev := range clusterEvents(prev.MemberStatuses, cur.MemberStatuses) {
+				if err := send("cluster", ev); err != nil {
+					return err
+				}
+			}
+			prev, lastSent = cur, time.Now()
+			continue
+		}
+
+		if time.Since(lastSent) >= statusStreamPingInterval {
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return err
+			}
+			flusher.Flush()
+			lastSent = time.Now()
+		}
+	}
+}
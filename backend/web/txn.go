@@ -0,0 +1,178 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+)
+
+// maxTxnOps is the maximum number of compares, and of operations
+// in each branch of 'txn'.
+var maxTxnOps = 16
+
+// TxnRequest is the transaction of 'txn': if all compares succeed,
+// the 'Then' operations run, otherwise the 'Else' operations.
+type TxnRequest struct {
+	Compares []TxnCompare
+	Then     []TxnOp
+	Else     []TxnOp
+}
+
+// TxnCompare compares the target of the key with the value.
+type TxnCompare struct {
+	Key string
+	// Target is 'value', 'version', 'create' (revision) or 'mod' (revision).
+	Target string
+	// Result is '=', '!=', '<' or '>'.
+	Result string
+	// Value is compared as a number, except for 'value'.
+	Value string
+}
+
+// TxnOp is an operation of 'txn'.
+type TxnOp struct {
+	Type        string // 'put', 'get', 'delete'
+	RangePrefix bool   // 'get', 'delete'
+	KeyValue    KeyValue
+}
+
+// TxnOpResponse is the response of an operation of 'txn'.
+type TxnOpResponse struct {
+	Op        TxnOp
+	KeyValues []KeyValue // 'get', and the previous key-values of 'delete'
+	Deleted   int64      // 'delete'
+}
+
+// escape HTML-escapes the keys and values, like those of ClientRequest.
+func (treq *TxnRequest) escape() {
+	for i := range treq.Compares {
+		treq.Compares[i].Key = template.HTMLEscapeString(treq.Compares[i].Key)
+		treq.Compares[i].Value = template.HTMLEscapeString(treq.Compares[i].Value)
+	}
+	for _, ops := range [][]TxnOp{treq.Then, treq.Else} {
+		for i := range ops {
+			ops[i].KeyValue.Key = template.HTMLEscapeString(ops[i].KeyValue.Key)
+			ops[i].KeyValue.Value = template.HTMLEscapeString(ops[i].KeyValue.Value)
+		}
+	}
+}
+
+// toCmps returns the compares of the transaction.
+func (treq *TxnRequest) toCmps() ([]clientv3.Cmp, error) {
+	if len(treq.Compares) > maxTxnOps {
+		return nil, fmt.Errorf("too many compares (%d, max %d)", len(treq.Compares), maxTxnOps)
+	}
+	cmps := make([]clientv3.Cmp, len(treq.Compares))
+	for i, c := range treq.Compares {
+		if c.Key == "" {
+			return nil, fmt.Errorf("compare #%d got empty key", i)
+		}
+		switch c.Result {
+		case "=", "!=", "<", ">":
+		default:
+			return nil, fmt.Errorf("compare #%d got unknown result %q", i, c.Result)
+		}
+
+		if c.Target == "value" {
+			cmps[i] = clientv3.Compare(clientv3.Value(c.Key), c.Result, c.Value)
+			continue
+		}
+		n, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("compare #%d got non-numeric %s %q", i, c.Target, c.Value)
+		}
+		switch c.Target {
+		case "version":
+			cmps[i] = clientv3.Compare(clientv3.Version(c.Key), c.Result, n)
+		case "create":
+			cmps[i] = clientv3.Compare(clientv3.CreateRevision(c.Key), c.Result, n)
+		case "mod":
+			cmps[i] = clientv3.Compare(clientv3.ModRevision(c.Key), c.Result, n)
+		default:
+			return nil, fmt.Errorf("compare #%d got unknown target %q", i, c.Target)
+		}
+	}
+	return cmps, nil
+}
+
+// toTxnOps returns the operations of a branch.
+func toTxnOps(branch string, tops []TxnOp) ([]clientv3.Op, error) {
+	if len(tops) > maxTxnOps {
+		return nil, fmt.Errorf("too many '%s' operations (%d, max %d)", branch, len(tops), maxTxnOps)
+	}
+	ops := make([]clientv3.Op, len(tops))
+	for i, op := range tops {
+		if op.KeyValue.Key == "" {
+			return nil, fmt.Errorf("'%s' operation #%d got empty key", branch, i)
+		}
+		var opts []clientv3.OpOption
+		if op.RangePrefix {
+			opts = append(opts, clientv3.WithPrefix())
+		}
+		switch op.Type {
+		case "put":
+			ops[i] = clientv3.OpPut(op.KeyValue.Key, op.KeyValue.Value)
+		case "get":
+			ops[i] = clientv3.OpGet(op.KeyValue.Key, opts...)
+		case "delete":
+			ops[i] = clientv3.OpDelete(op.KeyValue.Key, append(opts, clientv3.WithPrevKV())...)
+		default:
+			return nil, fmt.Errorf("'%s' operation #%d got unknown type %q", branch, i, op.Type)
+		}
+	}
+	return ops, nil
+}
+
+// txnOpResponses returns the responses of the operations of the branch that ran.
+func txnOpResponses(tops []TxnOp, resps []*pb.ResponseOp) []TxnOpResponse {
+	oresps := make([]TxnOpResponse, len(resps))
+	for i, r := range resps {
+		if i < len(tops) {
+			oresps[i].Op = tops[i]
+		}
+		switch {
+		case r.GetResponseRange() != nil:
+			oresps[i].KeyValues = toKeyValues(r.GetResponseRange().Kvs)
+		case r.GetResponseDeleteRange() != nil:
+			oresps[i].KeyValues = toKeyValues(r.GetResponseDeleteRange().PrevKvs)
+			oresps[i].Deleted = r.GetResponseDeleteRange().Deleted
+		}
+	}
+	return oresps
+}
+
+// txnOpResponseLine describes the response of an operation.
+func txnOpResponseLine(r TxnOpResponse) string {
+	switch r.Op.Type {
+	case "put":
+		return fmt.Sprintf("put (key: %s, value: %s)", r.Op.KeyValue.Key, r.Op.KeyValue.Value)
+	case "get":
+		if len(r.KeyValues) == 0 {
+			return fmt.Sprintf("get (key %q does not exist)", r.Op.KeyValue.Key)
+		}
+		s := "get"
+		for _, kv := range r.KeyValues {
+			s += fmt.Sprintf(" (key: %s, value: %s)", kv.Key, kv.Value)
+		}
+		return s
+	default:
+		return fmt.Sprintf("delete (key: %s, deleted %d)", r.Op.KeyValue.Key, r.Deleted)
+	}
+}
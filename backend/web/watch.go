@@ -0,0 +1,416 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+var (
+	// maxWatchEvents is the number of events kept for each watch, so that
+	// the browser can resume the stream after reconnecting.
+	maxWatchEvents = 1000
+
+	// maxUserWatches is the number of running watches of a user.
+	maxUserWatches = 5
+
+	// watchCheckInterval is the interval to check whether the member
+	// serving a watch has stopped. It is also the first interval between
+	// reconnects, doubled on each failure up to maxWatchReconnectInterval.
+	watchCheckInterval        = time.Second
+	maxWatchReconnectInterval = 30 * time.Second
+
+	// maxWatchReconnects is the number of reconnects in a row that fail
+	// to create the watch, before the watch ends with an error.
+	maxWatchReconnects = 10
+
+	errTooManyWatches = errors.New("too many watches are running; cancel one first")
+)
+
+// WatchEvent is an event of a watch, streamed by '/watch'.
+// Encode without json tags to make it parsable by Typescript.
+type WatchEvent struct {
+	// Seq is the sequence number of the event within the watch.
+	Seq int64
+
+	// Type is 'PUT' or 'DELETE' for key events, or 'RECONNECT' when
+	// the watch moves to other endpoints.
+	Type     string
+	Key      string
+	Value    string
+	Revision int64
+	PrevKV   *KeyValue `json:",omitempty"`
+
+	// Message describes the event.
+	Message string
+}
+
+// watchSession is a watch of a user, running until canceled.
+type watchSession struct {
+	id     string
+	userID string
+	cancel func()
+
+	mu     sync.Mutex
+	seq    int64
+	events []WatchEvent
+	done   bool
+	err    string
+
+	// changec is closed and replaced on every event
+	changec chan struct{}
+}
+
+func (ws *watchSession) add(ev WatchEvent) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.seq++
+	ev.Seq = ws.seq
+	ws.events = append(ws.events, ev)
+	if len(ws.events) > maxWatchEvents {
+		ws.events = ws.events[len(ws.events)-maxWatchEvents:]
+	}
+	close(ws.changec)
+	ws.changec = make(chan struct{})
+}
+
+func (ws *watchSession) finish(err error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.done = true
+	if err != nil {
+		ws.err = err.Error()
+	}
+	close(ws.changec)
+	ws.changec = make(chan struct{})
+}
+
+// since returns the events after the sequence number, and the channel
+// closed on the next change. 'done' is true if the watch has ended.
+func (ws *watchSession) since(seq int64) (evs []WatchEvent, changec <-chan struct{}, done bool, err string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for _, ev := range ws.events {
+		if ev.Seq > seq {
+			evs = append(evs, ev)
+		}
+	}
+	return evs, ws.changec, ws.done, ws.err
+}
+
+func (ws *watchSession) isDone() bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.done
+}
+
+// startWatch starts the watch of the request, and returns its ID.
+func (srv *Server) startWatch(backend Backend, userID string, creq ClientRequest) (string, error) {
+	srv.watchMu.Lock()
+	defer srv.watchMu.Unlock()
+
+	n := 0
+	for id, ws := range srv.watches {
+		if ws.userID != userID {
+			continue
+		}
+		if ws.isDone() {
+			delete(srv.watches, id) // no longer needed once a new one starts
+			continue
+		}
+		n++
+	}
+	if n >= maxUserWatches {
+		return "", errTooManyWatches
+	}
+
+	srv.watchSeq++
+	ctx, cancel := context.WithCancel(srv.rootCtx)
+	ws := &watchSession{
+		id:      fmt.Sprintf("%d-%s", srv.watchSeq, randBytes(8)),
+		userID:  userID,
+		cancel:  cancel,
+		changec: make(chan struct{}),
+	}
+	srv.watches[ws.id] = ws
+	go srv.runWatch(ctx, backend, ws, creq)
+	return ws.id, nil
+}
+
+// cancelWatches cancels the watches of the users for whom keep returns false.
+func (srv *Server) cancelWatches(keep func(userID string) bool) {
+	srv.watchMu.Lock()
+	defer srv.watchMu.Unlock()
+	for id, ws := range srv.watches {
+		if !keep(ws.userID) {
+			ws.cancel()
+			delete(srv.watches, id)
+		}
+	}
+}
+
+// userWatch returns the watch by its ID, if owned by the user.
+func (srv *Server) userWatch(userID, id string) (*watchSession, bool) {
+	srv.watchMu.Lock()
+	defer srv.watchMu.Unlock()
+	ws, ok := srv.watches[id]
+	if !ok || ws.userID != userID {
+		return nil, false
+	}
+	return ws, true
+}
+
+// runWatch watches until the context is canceled. If the serving member
+// stops, it resumes the watch from the next revision through the other
+// running endpoints of the request, or any running member.
+func (srv *Server) runWatch(ctx context.Context, backend Backend, ws *watchSession, creq ClientRequest) {
+	var err error
+	defer func() { ws.finish(err) }()
+
+	nextRev := creq.StartRevision
+	if nextRev == 0 {
+		// resume from the current revision, not from the reconnect time
+		var kv clientv3.KV
+		if kv, err = srv.userKV(backend, ws.userID); err != nil {
+			return
+		}
+		gctx, gcancel := context.WithTimeout(ctx, 3*time.Second)
+		resp, gerr := kv.Get(gctx, creq.KeyValue.Key, clientv3.WithCountOnly())
+		gcancel()
+		if err = gerr; err != nil {
+			return
+		}
+		nextRev = resp.Header.Revision + 1
+	}
+
+	var (
+		failures int
+		interval = watchCheckInterval
+	)
+	for {
+		eps := runningEndpoints(backend, creq.Endpoints)
+		var w clientv3.Watcher
+		w, err = srv.userWatcher(backend, ws.userID, eps...)
+		if err == ErrNotSupported {
+			return
+		}
+		if err == nil {
+			var created, reconnect bool
+			created, reconnect, err = srv.consumeWatch(ctx, backend, w, eps, ws, creq, &nextRev)
+			if !reconnect {
+				return
+			}
+			if created {
+				failures, interval = 0, watchCheckInterval
+			}
+		}
+
+		failures++
+		if failures > maxWatchReconnects {
+			err = fmt.Errorf("failed to reconnect watch %d times (%v)", maxWatchReconnects, err)
+			lg.Warnf("watch %s of user %q: %v", ws.id, ws.userID, err)
+			return
+		}
+		msg := fmt.Sprintf("reconnecting watch from revision %d in %v", nextRev, interval)
+		if err != nil {
+			msg = fmt.Sprintf("%s (%v)", msg, err)
+		}
+		lg.Infof("watch %s of user %q: %s", ws.id, ws.userID, msg)
+		ws.add(WatchEvent{Type: "RECONNECT", Revision: nextRev, Message: msg})
+
+		select {
+		case <-ctx.Done():
+			err = nil
+			return
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxWatchReconnectInterval {
+			interval = maxWatchReconnectInterval
+		}
+	}
+}
+
+// consumeWatch adds the events of a watch, and returns true when the watch
+// should be resumed on other endpoints. 'created' is true if the server
+// created the watch.
+func (srv *Server) consumeWatch(ctx context.Context, backend Backend, w clientv3.Watcher, eps []string, ws *watchSession, creq ClientRequest, nextRev *int64) (created, reconnect bool, err error) {
+	wctx, wcancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer wcancel()
+
+	opts := []clientv3.OpOption{clientv3.WithPrevKV(), clientv3.WithRev(*nextRev), clientv3.WithCreatedNotify()}
+	if creq.RangePrefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	wch := w.Watch(wctx, creq.KeyValue.Key, opts...)
+
+	ticker := time.NewTicker(watchCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return created, false, nil
+
+		case wr, ok := <-wch:
+			if !ok {
+				// the client is closed when its member stops
+				return created, ctx.Err() == nil, nil
+			}
+			if err = wr.Err(); err != nil {
+				if wr.CompactRevision != 0 {
+					return created, false, err
+				}
+				return created, true, err
+			}
+			if wr.Created {
+				created = true
+			}
+			for _, ev := range wr.Events {
+				ws.add(toWatchEvent(ev))
+				*nextRev = ev.Kv.ModRevision + 1
+			}
+
+		case <-ticker.C:
+			if len(eps) == 0 {
+				continue
+			}
+			if m, merr := backend.FindMember(eps[0]); merr == nil && m.Stopped {
+				return created, true, fmt.Errorf("%s stopped", m.Name)
+			}
+		}
+	}
+}
+
+func toWatchEvent(ev *clientv3.Event) WatchEvent {
+	wev := WatchEvent{
+		Type:     ev.Type.String(),
+		Key:      string(ev.Kv.Key),
+		Value:    string(ev.Kv.Value),
+		Revision: ev.Kv.ModRevision,
+	}
+	if ev.PrevKv != nil {
+		pkv := toKeyValue(ev.PrevKv)
+		wev.PrevKV = &pkv
+	}
+	wev.Message = fmt.Sprintf("%s %q (revision %d)", wev.Type, wev.Key, wev.Revision)
+	return wev
+}
+
+// runningEndpoints returns the endpoints of running members, or none
+// (i.e. any running member) if all of them have stopped.
+func runningEndpoints(backend Backend, eps []string) (running []string) {
+	for _, ep := range eps {
+		if m, err := backend.FindMember(ep); err == nil && !m.Stopped {
+			running = append(running, ep)
+		}
+	}
+	return running
+}
+
+// watchHandler streams the events of the watch of the 'id' query parameter
+// as Server-Sent Events on GET, resuming after the 'Last-Event-ID' header.
+// A 'watch-end' event is sent when the watch ends. DELETE cancels the watch.
+func (srv *Server) watchHandler(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	userID := *ctx.Value(userKey).(*string)
+	id := req.URL.Query().Get("id")
+	ws, ok := srv.userWatch(userID, id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("watch %q not found", id), http.StatusNotFound)
+		return nil
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return nil
+		}
+		seq, _ := strconv.ParseInt(req.Header.Get("Last-Event-ID"), 10, 64)
+
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Connection", "keep-alive")
+		h.Set("X-Accel-Buffering", "no") // for nginx
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			evs, changec, done, werr := ws.since(seq)
+			for _, ev := range evs {
+				data, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+				if _, err = fmt.Fprintf(w, "id: %d\nevent: watch\ndata: %s\n\n", ev.Seq, data); err != nil {
+					return err
+				}
+				seq = ev.Seq
+			}
+			if done {
+				cresp := ClientResponse{Success: werr == "", Result: fmt.Sprintf("watch %s ended", id)}
+				if werr != "" {
+					cresp.Result = fmt.Sprintf("watch %s failed (%s)", id, werr)
+				}
+				cresp.ResultLines = []string{cresp.Result}
+				data, err := json.Marshal(cresp)
+				if err != nil {
+					return err
+				}
+				if _, err = fmt.Fprintf(w, "event: watch-end\ndata: %s\n\n", data); err != nil {
+					return err
+				}
+				flusher.Flush()
+				return nil
+			}
+			flusher.Flush()
+
+			select {
+			case <-changec:
+			case <-req.Context().Done():
+				return nil
+			case <-srv.stopc:
+				return nil
+			}
+		}
+
+	case http.MethodDelete:
+		srv.watchMu.Lock()
+		delete(srv.watches, id)
+		srv.watchMu.Unlock()
+		ws.cancel()
+
+		cresp := ClientResponse{Success: true, Result: fmt.Sprintf("canceled watch %s", id)}
+		cresp.ResultLines = []string{cresp.Result}
+		return json.NewEncoder(w).Encode(cresp)
+
+	default:
+		http.Error(w, "Method Not Allowed", 405)
+	}
+
+	return nil
+}
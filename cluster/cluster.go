@@ -8,6 +8,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,7 +18,6 @@ import (
 
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/embed"
-	"github.com/coreos/etcd/pkg/netutil"
 	"github.com/coreos/etcd/pkg/transport"
 	"golang.org/x/sync/errgroup"
 )
@@ -29,13 +31,20 @@ type Cluster struct {
 	// opLock blocks Stop, Restart, Shutdown.
 	opLock sync.Mutex
 
-	mmu               sync.RWMutex // member change
-	size              int
-	LeadIdx           int
-	Members           []*Member
-	clientHostToIndex map[string]int
+	mmu                sync.RWMutex // member change
+	size               int
+	nameIdx            int // suffix of the last member name
+	lead               *Member
+	Members            []*Member
+	clientHostToMember map[string]*Member
 
-	clientDialTimeout time.Duration // for client requests
+	statusMu sync.RWMutex // to publish statuses from UpdateMemberStatus at once
+
+	clientDialTimeout int64 // time.Duration for client requests, accessed atomically
+
+	balancedMu      sync.Mutex
+	balancedClients map[string]*balancedClient // by the sorted endpoints
+	balancedClock   int64                      // incremented on each use
 
 	stopc chan struct{} // to signal UpdateMemberStatus
 
@@ -50,6 +59,7 @@ type Cluster struct {
 // Config defines etcd local cluster Configuration.
 type Config struct {
 	Size     int
+	MaxSize  int // defaults to DefaultMaxSize
 	RootDir  string
 	RootPort int
 
@@ -62,6 +72,10 @@ type Config struct {
 	RootCtx     context.Context
 	RootCancel  func()
 	DialTimeout time.Duration // for client requests
+
+	// StartStagger is the delay between starting each member,
+	// to spread out the load of starting large clusters.
+	StartStagger time.Duration
 }
 
 // PeerScheme returns the peer scheme.
@@ -86,10 +100,107 @@ func (c Config) ClientScheme() string {
 
 var defaultDialTimeout = time.Second
 
-// Start starts embedded etcd cluster.
-func Start(ccfg Config) (clus *Cluster, err error) {
-	if ccfg.Size > 7 {
-		return nil, fmt.Errorf("max cluster size is 7, got %d", ccfg.Size)
+// memberStatusTimeout bounds fetching the status of one member.
+var memberStatusTimeout = 3 * time.Second
+
+// DefaultMaxSize is the default maximum cluster size.
+const DefaultMaxSize = 7
+
+var defaultStartStagger = 100 * time.Millisecond
+
+// startAbortTimeout bounds the shutdown of a cluster that fails to start.
+var startAbortTimeout = 30 * time.Second
+
+// leaderTimeout returns how long to wait for leader election.
+// Larger clusters take longer to elect (more split votes) and commit.
+func leaderTimeout(size int) time.Duration {
+	return 10*time.Second + time.Duration(size)*time.Second
+}
+
+var (
+	// ErrMemberStopped is returned when the operation requires a running member.
+	ErrMemberStopped = errors.New("member is stopped")
+	// ErrQuorumLost is returned when less than quorum of members are running,
+	// or would be after the membership change.
+	ErrQuorumLost = errors.New("quorum is lost")
+	// ErrTimeout is returned when the operation does not complete before the context is done.
+	ErrTimeout = errors.New("operation timed out")
+	// ErrMemberNotFound is returned when no member matches the given name, ID or endpoint.
+	ErrMemberNotFound = errors.New("member not found")
+)
+
+// MembershipStage is a stage of membership change.
+type MembershipStage string
+
+const (
+	// StageMemberAdd adds the new member to raft membership.
+	StageMemberAdd MembershipStage = "member-add"
+	// StageStart starts the new member.
+	StageStart MembershipStage = "start"
+	// StageMemberRemove removes the member from raft membership.
+	StageMemberRemove MembershipStage = "member-remove"
+	// StageCatchUp waits for the new member to catch up with the leader.
+	StageCatchUp MembershipStage = "catch-up"
+)
+
+// MembershipError is returned when Add, Remove or Replace fails.
+// For Add and Remove, the cluster is left as it was before the call,
+// unless RollbackErr is not nil.
+type MembershipError struct {
+	Stage  MembershipStage
+	Member string
+	Err    error
+
+	// RollbackErr is the error from reverting raft membership, if any.
+	RollbackErr error
+}
+
+func (e *MembershipError) Error() string {
+	s := fmt.Sprintf("%s %q failed (%v)", e.Stage, e.Member, e.Err)
+	if e.RollbackErr != nil {
+		s += fmt.Sprintf("; rollback failed (%v)", e.RollbackErr)
+	}
+	return s
+}
+
+// StartError is returned when Start fails, and the members that started
+// could not be shut down. They may still hold their ports and data.
+type StartError struct {
+	Err error
+
+	// ShutdownErr is the error from shutting down the started members.
+	ShutdownErr error
+}
+
+func (e *StartError) Error() string {
+	return fmt.Sprintf("start failed (%v); shutdown failed (%v)", e.Err, e.ShutdownErr)
+}
+
+// toErr translates context errors to ErrTimeout.
+func toErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		return ErrTimeout
+	}
+	if ctx.Err() != nil {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Start starts embedded etcd cluster. If it fails to start, the started
+// members are shut down, their data is deleted and RootCancel is called.
+// It returns *StartError if they cannot be shut down.
+func Start(ctx context.Context, ccfg Config) (clus *Cluster, err error) {
+	maxSize := ccfg.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if ccfg.Size < 1 || ccfg.Size > maxSize {
+		return nil, fmt.Errorf("cluster size must be between 1 and %d, got %d", maxSize, ccfg.Size)
 	}
 
 	lg.Infof("starting %d Members (root directory %q, root port :%d)", ccfg.Size, ccfg.RootDir, ccfg.RootPort)
@@ -98,17 +209,22 @@ func Start(ccfg Config) (clus *Cluster, err error) {
 	if dt == time.Duration(0) {
 		dt = defaultDialTimeout
 	}
+	stagger := ccfg.StartStagger
+	if stagger == time.Duration(0) {
+		stagger = defaultStartStagger
+	}
 
 	clus = &Cluster{
-		embeddedClient:    ccfg.EmbeddedClient,
-		Started:           time.Now(),
-		size:              ccfg.Size,
-		Members:           make([]*Member, ccfg.Size),
-		clientHostToIndex: make(map[string]int, ccfg.Size),
-		clientDialTimeout: dt,
-		stopc:             make(chan struct{}),
-		rootCtx:           ccfg.RootCtx,
-		rootCancel:        ccfg.RootCancel,
+		embeddedClient:     ccfg.EmbeddedClient,
+		Started:            time.Now(),
+		size:               ccfg.Size,
+		nameIdx:            ccfg.Size,
+		Members:            make([]*Member, ccfg.Size),
+		clientHostToMember: make(map[string]*Member, ccfg.Size),
+		clientDialTimeout:  int64(dt),
+		stopc:              make(chan struct{}),
+		rootCtx:            ccfg.RootCtx,
+		rootCancel:         ccfg.RootCancel,
 
 		basePort: ccfg.RootPort,
 		rootDir:  ccfg.RootDir,
@@ -125,14 +241,7 @@ func Start(ccfg Config) (clus *Cluster, err error) {
 		os.RemoveAll(ccfg.RootDir)
 	}
 
-	lg.Infof("getting default host")
-	dhost, err := netutil.GetDefaultHost()
-	if err != nil {
-		lg.Warn(err)
-		lg.Warn("overwriting default host with 'localhost")
-		dhost = "localhost"
-	}
-	lg.Infof("detected default host %q", dhost)
+	dhost := defaultHost()
 
 	if !ccfg.PeerTLSInfo.Empty() && ccfg.PeerAutoTLS {
 		return nil, fmt.Errorf("choose either auto peer TLS or manual peer TLS")
@@ -143,81 +252,63 @@ func Start(ccfg Config) (clus *Cluster, err error) {
 
 	startPort := ccfg.RootPort
 	for i := 0; i < ccfg.Size; i++ {
-		cfg := embed.NewConfig()
-
+		cfg := clus.memberConfig(fmt.Sprintf("node%d", i+1), startPort, dhost)
 		cfg.ClusterState = embed.ClusterStateFlagNew
 
-		cfg.Name = fmt.Sprintf("node%d", i+1)
-		cfg.Dir = filepath.Join(ccfg.RootDir, cfg.Name+".data-dir-etcd")
-		cfg.WalDir = filepath.Join(ccfg.RootDir, cfg.Name+".data-dir-etcd", "wal")
-
-		// this is fresh cluster, so remove any conflicting data
-		os.RemoveAll(cfg.Dir)
-		lg.Infof("removed %q", cfg.Dir)
-		os.RemoveAll(cfg.WalDir)
-		lg.Infof("removed %q", cfg.WalDir)
-
-		curl := url.URL{Scheme: ccfg.ClientScheme(), Host: fmt.Sprintf("localhost:%d", startPort)}
-		cfg.ACUrls = []url.URL{curl}
-		cfg.LCUrls = []url.URL{curl}
-		if dhost != "localhost" {
-			// expose default host to other machines in listen address (e.g. Prometheus dashboard)
-			curl2 := url.URL{Scheme: ccfg.ClientScheme(), Host: fmt.Sprintf("%s:%d", dhost, startPort)}
-			cfg.LCUrls = append(cfg.LCUrls, curl2)
-			lg.Infof("%q is set up to listen on client url %q (default host)", cfg.Name, curl2.String())
-		}
-		lg.Infof("%q is set up to listen on client url %q", cfg.Name, curl.String())
-
-		purl := url.URL{Scheme: ccfg.PeerScheme(), Host: fmt.Sprintf("localhost:%d", startPort+1)}
-		cfg.APUrls = []url.URL{purl}
-		cfg.LPUrls = []url.URL{purl}
-		lg.Infof("%q is set up to listen on peer url %q", cfg.Name, purl.String())
-
-		cfg.ClientAutoTLS = ccfg.ClientAutoTLS
-		cfg.ClientTLSInfo = ccfg.ClientTLSInfo
-		cfg.PeerAutoTLS = ccfg.PeerAutoTLS
-		cfg.PeerTLSInfo = ccfg.PeerTLSInfo
-
-		// auto-compaction every hour
-		cfg.AutoCompactionMode = embed.CompactorModePeriodic
-		cfg.AutoCompactionRetention = "1h"
-
-		cfg.Logger = "zap"
-		cfg.LogOutputs = []string{embed.StdErrLogOutput}
-
-		clus.Members[i] = &Member{
-			clus: clus,
-			cfg:  cfg,
-			status: clusterpb.MemberStatus{
-				Name:     cfg.Name,
-				Endpoint: curl.String(),
-				IsLeader: false,
-				State:    clusterpb.StoppedMemberStatus,
-			},
-		}
-
-		clus.clientHostToIndex[curl.Host] = i
+		clus.Members[i] = newMember(clus, cfg)
+		clus.clientHostToMember[cfg.LCUrls[0].Host] = clus.Members[i]
 
 		startPort += 2
 	}
 	clus.basePort = startPort
 
 	for i := 0; i < clus.size; i++ {
-		clus.Members[i].cfg.InitialCluster = clus.initialCluster()
+		clus.Members[i].setInitialCluster(clus.initialCluster())
 	}
 
+	// do not leave the started members running, since the caller
+	// gets no cluster to shut down
+	started := clus
+	defer func() {
+		if err == nil {
+			return
+		}
+		sctx, scancel := context.WithTimeout(context.Background(), startAbortTimeout)
+		if serr := started.Shutdown(sctx); serr != nil {
+			lg.Warnf("failed to shut down the cluster that failed to start (%v)", serr)
+			err = &StartError{Err: err, ShutdownErr: serr}
+		}
+		scancel()
+	}()
+
 	var g errgroup.Group
 	for i := 0; i < clus.size; i++ {
 		idx := i
-		g.Go(func() error { return clus.Members[idx].Start() })
+		g.Go(func() error {
+			select {
+			case <-time.After(time.Duration(idx) * stagger):
+			case <-ctx.Done():
+				return ErrTimeout
+			}
+			return clus.Members[idx].Start(ctx)
+		})
 	}
 	if gerr := g.Wait(); gerr != nil {
 		return nil, gerr
 	}
 
-	time.Sleep(time.Second)
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return nil, ErrTimeout
+	}
 
-	return clus, clus.WaitForLeader()
+	now := time.Now()
+	if err = clus.WaitForLeader(ctx); err != nil {
+		return nil, err
+	}
+	lg.Infof("elected leader among %d Members (took %v)", clus.size, time.Since(now))
+	return clus, nil
 }
 
 // StopNotify returns receive-only stop channel to notify the cluster has stopped.
@@ -225,68 +316,61 @@ func (clus *Cluster) StopNotify() <-chan struct{} {
 	return clus.stopc
 }
 
-// Stop stops a node.
-func (clus *Cluster) Stop(i int) {
+// Stop stops a node by its name or ID.
+// It returns ErrMemberStopped if the node is already stopped.
+func (clus *Cluster) Stop(ctx context.Context, key string) error {
 	clus.opLock.Lock()
 	defer clus.opLock.Unlock()
-	clus.Members[i].Stop()
-}
-
-// Restart restarts a node.
-func (clus *Cluster) Restart(i int) error {
-	clus.opLock.Lock()
-	defer clus.opLock.Unlock()
-	return clus.Members[i].Restart()
-}
 
-// Add adds one member.
-func (clus *Cluster) Add() error {
-	lg.Infof("getting default host")
-	dhost, err := netutil.GetDefaultHost()
+	m, err := clus.Member(key)
 	if err != nil {
-		lg.Warn(err)
-		lg.Warn("overwriting default host with 'localhost")
-		dhost = "localhost"
+		return err
 	}
-	lg.Infof("detected default host %q", dhost)
+	return m.Stop(ctx)
+}
 
+// Restart restarts a node by its name or ID.
+func (clus *Cluster) Restart(ctx context.Context, key string) error {
 	clus.opLock.Lock()
 	defer clus.opLock.Unlock()
 
-	clus.mmu.Lock()
-	defer clus.mmu.Unlock()
+	m, err := clus.Member(key)
+	if err != nil {
+		return err
+	}
+	return m.Restart(ctx)
+}
 
+// memberConfig returns the configuration of a member that serves
+// clients on 'port' and peers on 'port+1'. It removes any existing data.
+func (clus *Cluster) memberConfig(name string, port int, dhost string) *embed.Config {
 	cfg := embed.NewConfig()
 
-	cfg.ClusterState = embed.ClusterStateFlagExisting
-
-	cfg.Name = fmt.Sprintf("node%d", clus.size+1)
+	cfg.Name = name
 	cfg.Dir = filepath.Join(clus.rootDir, cfg.Name+".data-dir-etcd")
 	cfg.WalDir = filepath.Join(clus.rootDir, cfg.Name+".data-dir-etcd", "wal")
 
-	// this is fresh cluster, so remove any conflicting data
+	// this is fresh member, so remove any conflicting data
 	os.RemoveAll(cfg.Dir)
 	lg.Infof("removed %q", cfg.Dir)
 	os.RemoveAll(cfg.WalDir)
 	lg.Infof("removed %q", cfg.WalDir)
 
-	curl := url.URL{Scheme: clus.ccfg.ClientScheme(), Host: fmt.Sprintf("localhost:%d", clus.basePort)}
+	curl := url.URL{Scheme: clus.ccfg.ClientScheme(), Host: fmt.Sprintf("localhost:%d", port)}
 	cfg.ACUrls = []url.URL{curl}
 	cfg.LCUrls = []url.URL{curl}
 	if dhost != "localhost" {
 		// expose default host to other machines in listen address (e.g. Prometheus dashboard)
-		curl2 := url.URL{Scheme: clus.ccfg.ClientScheme(), Host: fmt.Sprintf("%s:%d", dhost, clus.basePort)}
+		curl2 := url.URL{Scheme: clus.ccfg.ClientScheme(), Host: fmt.Sprintf("%s:%d", dhost, port)}
 		cfg.LCUrls = append(cfg.LCUrls, curl2)
 		lg.Infof("%q is set up to listen on client url %q (default host)", cfg.Name, curl2.String())
 	}
 	lg.Infof("%q is set up to listen on client url %q", cfg.Name, curl.String())
 
-	purl := url.URL{Scheme: clus.ccfg.PeerScheme(), Host: fmt.Sprintf("localhost:%d", clus.basePort+1)}
+	purl := url.URL{Scheme: clus.ccfg.PeerScheme(), Host: fmt.Sprintf("localhost:%d", port+1)}
 	cfg.APUrls = []url.URL{purl}
 	cfg.LPUrls = []url.URL{purl}
-
-	clus.size++
-	clus.basePort += 2
+	lg.Infof("%q is set up to listen on peer url %q", cfg.Name, purl.String())
 
 	cfg.ClientAutoTLS = clus.ccfg.ClientAutoTLS
 	cfg.ClientTLSInfo = clus.ccfg.ClientTLSInfo
@@ -297,95 +381,224 @@ func (clus *Cluster) Add() error {
 	cfg.AutoCompactionMode = embed.CompactorModePeriodic
 	cfg.AutoCompactionRetention = "1h"
 
-	clus.Members = append(clus.Members, &Member{
-		clus: clus,
-		cfg:  cfg,
-		status: clusterpb.MemberStatus{
-			Name:     cfg.Name,
-			Endpoint: curl.String(),
-			IsLeader: false,
-			State:    clusterpb.StoppedMemberStatus,
-		},
-	})
-	idx := len(clus.Members) - 1
-	clus.clientHostToIndex[curl.Host] = idx
+	// checked by keepsQuorum instead
+	cfg.StrictReconfigCheck = false
+
+	cfg.Logger = "zap"
+	cfg.LogOutputs = []string{embed.StdErrLogOutput}
+
+	return cfg
+}
+
+// Add adds one member, and returns its handle. On failure, it returns
+// *MembershipError after reverting the local and raft membership.
+func (clus *Cluster) Add(ctx context.Context) (*Member, error) {
+	dhost := defaultHost()
+
+	clus.opLock.Lock()
+	defer clus.opLock.Unlock()
+
+	clus.mmu.Lock()
+	defer clus.mmu.Unlock()
+
+	am := clus.activeMember(nil)
+	if am == nil || !clus.keepsQuorum(clus.size+1, nil) {
+		return nil, ErrQuorumLost
+	}
+
+	// names are never reused, so that handles and names
+	// of removed members do not point to new members
+	clus.nameIdx++
+	cfg := clus.memberConfig(fmt.Sprintf("node%d", clus.nameIdx), clus.basePort, dhost)
+	clus.basePort += 2
+
+	m, err := clus.addMember(ctx, am, cfg)
+	if err != nil {
+		clus.nameIdx--
+		clus.basePort -= 2
+	}
+	return m, err
+}
+
+// addMember adds the member to the cluster via 'am' and starts it.
+// On failure, it reverts the local and raft membership.
+// It must be called with 'opLock' and 'mmu' locked.
+func (clus *Cluster) addMember(ctx context.Context, am *Member, cfg *embed.Config) (*Member, error) {
+	cfg.ClusterState = embed.ClusterStateFlagExisting
+
+	m := newMember(clus, cfg)
+	clus.Members = append(clus.Members, m)
+	clus.size++
+	clus.clientHostToMember[cfg.LCUrls[0].Host] = m
 
 	for i := 0; i < clus.size; i++ {
-		clus.Members[i].cfg.InitialCluster = clus.initialCluster()
+		clus.Members[i].setInitialCluster(clus.initialCluster())
+	}
+
+	// rollback reverts local bookkeeping, and raft membership if 'cli' is not nil
+	rollback := func(stage MembershipStage, err error, cli *clientv3.Client) error {
+		merr := &MembershipError{Stage: stage, Member: m.cfg.Name, Err: toErr(ctx, err)}
+		lg.Warnf("rolling back %q (%v)", m.cfg.Name, merr.Err)
+		if cli != nil {
+			// failed 'MemberAdd' may have been applied, so look up by peer URL;
+			// 'ctx' may be done already
+			rctx, rcancel := context.WithTimeout(clus.rootCtx, 3*time.Second)
+			merr.RollbackErr = removeByPeerURL(rctx, cli, m.cfg.APUrls[0].String())
+			rcancel()
+		}
+		clus.detach(m)
+		os.RemoveAll(m.cfg.Dir)
+		lg.Warnf("rolled back %q (%v)", m.cfg.Name, merr)
+		return merr
 	}
 
-	lg.Infof("adding member %q", clus.Members[idx].cfg.Name)
-	cli, _, err := clus.Members[0].Client(false)
+	lg.Infof("adding member %q", m.cfg.Name)
+	if ctx.Err() != nil {
+		// a proposal with done context may still be applied later,
+		// after the rollback has looked it up
+		return nil, rollback(StageMemberAdd, ctx.Err(), nil)
+	}
+	cli, err := am.PooledClient()
 	if err != nil {
-		return err
+		return nil, rollback(StageMemberAdd, err, nil)
 	}
-	ctx, cancel := context.WithTimeout(clus.rootCtx, 3*time.Second)
-	_, err = cli.MemberAdd(ctx, []string{clus.Members[idx].cfg.APUrls[0].String()})
-	cancel()
+	actx, acancel := context.WithTimeout(ctx, 3*time.Second)
+	_, err = cli.MemberAdd(actx, []string{m.cfg.APUrls[0].String()})
+	acancel()
 	if err != nil {
-		return err
+		return nil, rollback(StageMemberAdd, err, cli)
 	}
-	lg.Infof("added member %q", clus.Members[idx].cfg.Name)
+	lg.Infof("added member %q", m.cfg.Name)
 
-	lg.Infof("starting member %q", clus.Members[idx].cfg.Name)
-	if serr := clus.Members[idx].Start(); serr != nil {
-		return serr
+	lg.Infof("starting member %q", m.cfg.Name)
+	if serr := m.Start(ctx); serr != nil {
+		return nil, rollback(StageStart, serr, cli)
 	}
-	lg.Infof("started member %q", clus.Members[idx].cfg.Name)
+	lg.Infof("started member %q", m.cfg.Name)
 
-	return nil
+	return m, nil
 }
 
-// Remove removes the member and its data.
-func (clus *Cluster) Remove(i int) error {
+// Replace replaces the member by its name or ID with a fresh member
+// of the same name and URLs, and waits until the new member catches
+// up with the leader's raft index. The old member is removed and its
+// data is deleted first, so if adding the new member fails, the cluster
+// is left as if Remove was called. The returned *MembershipError names
+// the stage that failed; if the new member only failed to catch up, its
+// handle is returned as well.
+func (clus *Cluster) Replace(ctx context.Context, key string) (*Member, error) {
+	dhost := defaultHost()
+
 	clus.opLock.Lock()
 	defer clus.opLock.Unlock()
 
 	clus.mmu.Lock()
 	defer clus.mmu.Unlock()
 
-	idx := (i + 1) % clus.size
-	lg.Infof("removing member %q", clus.Members[i].cfg.Name)
-	cli, _, err := clus.Members[idx].Client(false)
+	old, err := clus.member(key)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	port, err := strconv.Atoi(old.cfg.LCUrls[0].Port())
+	if err != nil {
+		return nil, err
+	}
+	am := clus.activeMember(old)
+	if am == nil || !clus.keepsQuorum(clus.size, old) {
+		return nil, ErrQuorumLost
+	}
+
+	if err = clus.removeMember(ctx, am, old); err != nil {
+		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(clus.rootCtx, 3*time.Second)
-	_, err = cli.MemberRemove(ctx, uint64(clus.Members[i].srv.Server.ID()))
-	cancel()
+
+	// removing the leader triggers an election, during which
+	// 'MemberAdd' may time out
+	if _, err = clus.leaderIndex(ctx, nil); err != nil {
+		return nil, &MembershipError{Stage: StageMemberAdd, Member: old.cfg.Name, Err: err}
+	}
+	if am = clus.activeMember(nil); am == nil {
+		return nil, ErrQuorumLost
+	}
+
+	cfg := clus.memberConfig(old.cfg.Name, port, dhost)
+	m, err := clus.addMember(ctx, am, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lg.Infof("waiting for %q to catch up", m.cfg.Name)
+	if err = clus.waitForCatchUp(ctx, m); err != nil {
+		return m, &MembershipError{Stage: StageCatchUp, Member: m.cfg.Name, Err: err}
+	}
+	lg.Infof("%q has caught up", m.cfg.Name)
+	return m, nil
+}
+
+// Remove removes the member by its name or ID, and its data.
+// It returns *MembershipError and leaves the cluster unchanged,
+// if the member cannot be removed from raft membership. Once removed,
+// failures to stop the member or to delete its data are only logged.
+func (clus *Cluster) Remove(ctx context.Context, key string) error {
+	clus.opLock.Lock()
+	defer clus.opLock.Unlock()
+
+	clus.mmu.Lock()
+	defer clus.mmu.Unlock()
+
+	m, err := clus.member(key)
 	if err != nil {
 		return err
 	}
-	lg.Infof("removed member %q", clus.Members[idx].cfg.Name)
+	am := clus.activeMember(m)
+	if am == nil || !clus.keepsQuorum(clus.size-1, m) {
+		return ErrQuorumLost
+	}
+	return clus.removeMember(ctx, am, m)
+}
 
-	clus.size--
-	var newms []*Member
-	for j := range clus.Members {
-		if j == i {
-			continue
-		}
-		newms = append(newms, clus.Members[j])
+// removeMember removes the member from the cluster via 'am', stops it
+// and deletes its data. It must be called with 'opLock' and 'mmu' locked.
+func (clus *Cluster) removeMember(ctx context.Context, am, m *Member) error {
+	lg.Infof("removing member %q", m.cfg.Name)
+	cli, err := am.PooledClient()
+	if err != nil {
+		return &MembershipError{Stage: StageMemberRemove, Member: m.cfg.Name, Err: err}
 	}
-	clus.Members = newms
-	for j, m := range clus.Members {
-		clus.clientHostToIndex[m.cfg.LCUrls[0].Host] = j
+	rctx, rcancel := context.WithTimeout(ctx, 3*time.Second)
+	_, err = cli.MemberRemove(rctx, uint64(m.ID()))
+	rcancel()
+	if err != nil {
+		return &MembershipError{Stage: StageMemberRemove, Member: m.cfg.Name, Err: toErr(ctx, err)}
 	}
+	lg.Infof("removed member %q", m.cfg.Name)
+
+	clus.detach(m)
+	clus.closeBalancedClients(m.cfg.LCUrls[0].String())
 
-	clus.Members[i].Stop()
+	if serr := m.Stop(ctx); serr != nil && serr != ErrMemberStopped {
+		lg.Warnf("failed to stop removed member (%v)", serr)
+	}
+	m.closeConns()
 
-	os.RemoveAll(clus.Members[i].cfg.Dir)
-	lg.Infof("removed %q", clus.Members[i].cfg.Dir)
+	os.RemoveAll(m.cfg.Dir)
+	lg.Infof("removed %q", m.cfg.Dir)
 
-	os.RemoveAll(clus.Members[i].cfg.WalDir)
-	lg.Infof("removed %q", clus.Members[i].cfg.WalDir)
+	os.RemoveAll(m.cfg.WalDir)
+	lg.Infof("removed %q", m.cfg.WalDir)
 
 	return nil
 }
 
 // Shutdown stops all Members and deletes all data directories.
-func (clus *Cluster) Shutdown() {
-	clus.rootCancel()
+// It returns ErrTimeout if Members do not stop before the context is done,
+// in which case data directories are left in place.
+func (clus *Cluster) Shutdown(ctx context.Context) error {
+	if clus.rootCancel != nil {
+		clus.rootCancel()
+	}
 	close(clus.stopc) // stopping UpdateMemberStatus
+	clus.closeBalancedClients("")
 
 	clus.opLock.Lock()
 	defer clus.opLock.Unlock()
@@ -396,23 +609,51 @@ func (clus *Cluster) Shutdown() {
 	for i := 0; i < clus.size; i++ {
 		go func(i int) {
 			defer wg.Done()
-			clus.Members[i].Stop()
+			if err := clus.Members[i].Stop(ctx); err != nil && err != ErrMemberStopped {
+				lg.Warnf("failed to stop %q (%v)", clus.Members[i].cfg.Name, err)
+			}
+			clus.Members[i].closeConns()
 		}(i)
 	}
-	wg.Wait()
+	donec := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(donec)
+	}()
+	select {
+	case <-donec:
+	case <-ctx.Done():
+		lg.Warnf("shutdown timed out (%v)", ctx.Err())
+		return ErrTimeout
+	}
 
 	os.RemoveAll(clus.rootDir)
 	lg.Infof("successfully shutdown cluster (deleted %q)", clus.rootDir)
+	return nil
 }
 
 // WaitForLeader waits for cluster to elect a new leader.
-func (clus *Cluster) WaitForLeader() error {
+// It returns ErrQuorumLost if less than quorum of Members are running,
+// since no leader can be elected. The wait is bounded by a timeout
+// that grows with the cluster size.
+func (clus *Cluster) WaitForLeader(ctx context.Context) error {
+	if clus.ActiveNodeN() < clus.Quorum() {
+		return ErrQuorumLost
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, leaderTimeout(clus.Size()))
+	defer cancel()
+
 	lg.Info("wait for leader election")
 	var g errgroup.Group
-	for i := 0; i < clus.size; i++ {
-		idx := i
+	for _, m := range clus.AllMembers() {
+		m := m
 		g.Go(func() error {
-			return clus.Members[idx].WaitForLeader()
+			err := m.WaitForLeader(ctx)
+			if err == ErrMemberStopped {
+				return nil
+			}
+			return err
 		})
 	}
 	if gerr := g.Wait(); gerr != nil {
@@ -423,17 +664,20 @@ func (clus *Cluster) WaitForLeader() error {
 	clus.mmu.Lock()
 	defer clus.mmu.Unlock()
 
-	found := false
-	for i, m := range clus.Members {
-		if m.status.IsLeader {
-			if found {
-				return fmt.Errorf("duplicate leader? %q(%s) claims to be the leader", clus.Members[clus.LeadIdx].cfg.Name, clus.Members[clus.LeadIdx].srv.Server.ID())
+	var lead *Member
+	for _, m := range clus.Members {
+		m.statusLock.RLock()
+		isLeader := m.status.IsLeader
+		m.statusLock.RUnlock()
+		if isLeader {
+			if lead != nil {
+				return fmt.Errorf("duplicate leader? %q(%s) claims to be the leader", m.cfg.Name, m.ID())
 			}
-			clus.LeadIdx = i
-			lg.Infof("%q(%s) is the leader", m.cfg.Name, m.srv.Server.ID())
-			found = true
+			lead = m
+			lg.Infof("%q(%s) is the leader", m.cfg.Name, m.ID())
 		}
 	}
+	clus.lead = lead
 	return nil
 }
 
@@ -442,49 +686,166 @@ func (clus *Cluster) Client(eps ...string) (*clientv3.Client, *tls.Config, error
 	if len(eps) == 0 {
 		return nil, nil, errors.New("no endpoint is given")
 	}
-	idx, ok := clus.clientHostToIndex[getHost(eps[0])]
-	if !ok {
+	m, err := clus.FindMember(eps[0])
+	if err != nil {
 		return nil, nil, fmt.Errorf("cannot find node with endpoint %s", eps[0])
 	}
-	return clus.Members[idx].Client(false, eps...)
+	return m.Client(false, eps...)
 }
 
-// UpdateMemberStatus updates node statuses.
-func (clus *Cluster) UpdateMemberStatus() {
-	clus.mmu.Lock()
-	defer clus.mmu.Unlock()
+// PooledClient returns the cached client of the member that serves
+// the first endpoint. Callers must not close the client.
+func (clus *Cluster) PooledClient(eps ...string) (*clientv3.Client, error) {
+	if len(eps) == 0 {
+		return nil, errors.New("no endpoint is given")
+	}
+	m, err := clus.FindMember(eps[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot find node with endpoint %s", eps[0])
+	}
+	return m.PooledClient(eps...)
+}
+
+// maxBalancedClients is the maximum number of cached balanced clients.
+// The least recently used client is closed to cache a new one.
+const maxBalancedClients = 16
+
+type balancedClient struct {
+	*clientv3.Client
+	urls []string
+	used int64 // 'balancedClock' of the last use
+}
+
+// BalancedClient returns the cached client that connects to the members
+// of all endpoints through the client balancer, even with embedded clients.
+// Unlike PooledClient, it is not closed when a member stops, so requests
+// fail over to the other endpoints. It is closed when one of its members
+// is removed or replaced, or when it is evicted from the cache. Callers
+// must not close the client, nor keep it beyond a request.
+func (clus *Cluster) BalancedClient(eps ...string) (*clientv3.Client, error) {
+	if len(eps) == 0 {
+		return nil, errors.New("no endpoint is given")
+	}
+	var (
+		cfg  embed.Config
+		seen = make(map[string]bool)
+		urls []string
+	)
+	for _, ep := range eps {
+		m, err := clus.FindMember(ep)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find node with endpoint %s", ep)
+		}
+		cfg = m.Config()
+		if u := cfg.LCUrls[0].String(); !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	sort.Strings(urls)
+
+	clus.balancedMu.Lock()
+	defer clus.balancedMu.Unlock()
+
+	clus.balancedClock++
+	key := strings.Join(urls, ",")
+	if bc, ok := clus.balancedClients[key]; ok {
+		bc.used = clus.balancedClock
+		return bc.Client, nil
+	}
+	ccfg := clientv3.Config{
+		Endpoints:   urls,
+		DialTimeout: clus.dialTimeout(),
+	}
+	if !cfg.ClientTLSInfo.Empty() {
+		tlsCfg, err := cfg.ClientTLSInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		ccfg.TLS = tlsCfg
+	}
+	cli, err := clientv3.New(ccfg)
+	if err != nil {
+		return nil, err
+	}
+	if clus.balancedClients == nil {
+		clus.balancedClients = make(map[string]*balancedClient)
+	}
+	if len(clus.balancedClients) >= maxBalancedClients {
+		lruKey := ""
+		for k, bc := range clus.balancedClients {
+			if lruKey == "" || bc.used < clus.balancedClients[lruKey].used {
+				lruKey = k
+			}
+		}
+		clus.balancedClients[lruKey].Close()
+		delete(clus.balancedClients, lruKey)
+	}
+	clus.balancedClients[key] = &balancedClient{Client: cli, urls: urls, used: clus.balancedClock}
+	return cli, nil
+}
+
+// closeBalancedClients closes the cached balanced clients that connect
+// to the URL, or all of them if the URL is empty.
+func (clus *Cluster) closeBalancedClients(url string) {
+	clus.balancedMu.Lock()
+	defer clus.balancedMu.Unlock()
+	for key, bc := range clus.balancedClients {
+		// the URLs are sorted
+		if i := sort.SearchStrings(bc.urls, url); url != "" && (i == len(bc.urls) || bc.urls[i] != url) {
+			continue
+		}
+		bc.Close()
+		delete(clus.balancedClients, key)
+	}
+}
+
+// UpdateMemberStatus updates node statuses. It fetches the statuses of
+// a snapshot of Members without holding the membership lock, each bounded
+// by 'memberStatusTimeout', and publishes them at once. A status is dropped
+// if the member was stopped or restarted while being fetched.
+func (clus *Cluster) UpdateMemberStatus(ctx context.Context) {
+	clus.mmu.RLock()
+	ms := make([]*Member, len(clus.Members))
+	copy(ms, clus.Members)
+	clus.mmu.RUnlock()
+
+	since := make([]time.Time, len(ms))
+	for i, m := range ms {
+		since[i] = m.StoppedStartedAt()
+	}
 
+	sts := make([]clusterpb.MemberStatus, len(ms))
 	var wg sync.WaitGroup
-	wg.Add(clus.size)
-	for i := 0; i < clus.size; i++ {
+	wg.Add(len(ms))
+	for i := range ms {
 		go func(i int) {
-			defer func() {
-				if err := recover(); err != nil {
-					lg.Warn("recovered from panic", err)
-					select {
-					case <-clus.rootCtx.Done():
-						lg.Warn("rootCtx is done with", clus.rootCtx.Err())
-					default:
-					}
-				}
-				wg.Done()
-			}()
-			if err := clus.Members[i].FetchMemberStatus(); err != nil {
-				lg.Warn(err)
+			defer wg.Done()
+			mctx, mcancel := context.WithTimeout(ctx, memberStatusTimeout)
+			var err error
+			sts[i], err = ms[i].fetchStatus(mctx)
+			mcancel()
+			if err != nil {
+				lg.Warnf("failed to fetch status of %q (%v)", ms[i].cfg.Name, err)
 			}
 		}(i)
 	}
-
-	wf := func() <-chan struct{} {
-		wg.Wait()
-		ch := make(chan struct{})
-		close(ch)
-		return ch
-	}
+	wg.Wait()
 
 	select {
 	case <-clus.stopc:
-	case <-wf():
+		return
+	default:
+	}
+
+	clus.statusMu.Lock()
+	defer clus.statusMu.Unlock()
+	for i, m := range ms {
+		if !m.StoppedStartedAt().Equal(since[i]) {
+			continue
+		}
+		m.statusLock.Lock()
+		m.status = sts[i]
+		m.statusLock.Unlock()
 	}
-	return
 }
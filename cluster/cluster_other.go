@@ -1,7 +1,9 @@
 package cluster
 
 import (
+	"context"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/etcd/embed"
@@ -25,26 +27,73 @@ func (clus *Cluster) InitialCluster() string {
 
 // allMemberIDs returns all member IDs.
 func (clus *Cluster) allMemberIDs() map[uint64]bool {
-	ms := make(map[uint64]bool, len(clus.Members))
-	for _, m := range clus.Members {
-		ms[uint64(m.srv.Server.ID())] = true
+	ms := make(map[uint64]bool)
+	for _, m := range clus.AllMembers() {
+		ms[uint64(m.ID())] = true
 	}
 	return ms
 }
 
-// SetClientDialTimeout sets the client dial timeout.
-func (clus *Cluster) SetClientDialTimeout(d time.Duration) {
-	clus.clientDialTimeout = d
+// detach removes the member from local bookkeeping.
+// It must be called with 'mmu' locked.
+func (clus *Cluster) detach(m *Member) {
+	var ms []*Member
+	for _, om := range clus.Members {
+		if om != m {
+			ms = append(ms, om)
+		}
+	}
+	clus.Members = ms
+	clus.size = len(ms)
+	delete(clus.clientHostToMember, m.cfg.LCUrls[0].Host)
+	if clus.lead == m {
+		clus.lead = nil
+	}
+	for _, om := range clus.Members {
+		om.setInitialCluster(clus.initialCluster())
+	}
+}
+
+// activeMember returns a running member other than 'except', preferring
+// the leader, so that membership changes are proposed without forwarding.
+// It returns nil if none.
+func (clus *Cluster) activeMember(except *Member) *Member {
+	var am *Member
+	for _, m := range clus.Members {
+		if m == except || m.IsStopped() {
+			continue
+		}
+		if srv := m.server(); srv != nil && srv.Server.Lead() == uint64(srv.Server.ID()) {
+			return m
+		}
+		if am == nil {
+			am = m
+		}
+	}
+	return am
+}
+
+// keepsQuorum returns true if the running Members other than 'except'
+// make a quorum of a cluster of 'size'. This replaces etcd's strict
+// reconfiguration check, which reads membership without locks.
+// It must be called with 'mmu' locked.
+func (clus *Cluster) keepsQuorum(size int, except *Member) bool {
+	cnt := 0
+	for _, m := range clus.Members {
+		if m != except && !m.IsStopped() {
+			cnt++
+		}
+	}
+	return cnt >= size/2+1
 }
 
-// StoppedStartedAt returns the node's last stop and (re)start action time.
-func (clus *Cluster) StoppedStartedAt(i int) time.Time {
-	return clus.Members[i].stoppedStartedAt
+// SetClientDialTimeout sets the client dial timeout.
+func (clus *Cluster) SetClientDialTimeout(d time.Duration) {
+	atomic.StoreInt64(&clus.clientDialTimeout, int64(d))
 }
 
-// Config returns the configuration of the server.
-func (clus *Cluster) Config(i int) embed.Config {
-	return *clus.Members[i].cfg
+func (clus *Cluster) dialTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&clus.clientDialTimeout))
 }
 
 // AllConfigs returns all configurations.
@@ -54,27 +103,11 @@ func (clus *Cluster) AllConfigs() []embed.Config {
 
 	cs := make([]embed.Config, clus.size)
 	for i := range clus.Members {
-		cs[i] = *clus.Members[i].cfg
+		cs[i] = clus.Members[i].Config()
 	}
 	return cs
 }
 
-// Endpoints returns the endpoints of the node.
-func (clus *Cluster) Endpoints(i int, scheme bool) []string {
-	clus.mmu.RLock()
-	defer clus.mmu.RUnlock()
-
-	var eps []string
-	for _, ep := range clus.Members[i].cfg.LCUrls {
-		if scheme {
-			eps = append(eps, ep.String())
-		} else {
-			eps = append(eps, ep.Host)
-		}
-	}
-	return eps
-}
-
 // AllEndpoints returns all endpoints of clients.
 func (clus *Cluster) AllEndpoints(scheme bool) []string {
 	clus.mmu.RLock()
@@ -91,17 +124,6 @@ func (clus *Cluster) AllEndpoints(scheme bool) []string {
 	return eps
 }
 
-// IsStopped returns true if the node has stopped.
-func (clus *Cluster) IsStopped(i int) (stopped bool) {
-	clus.mmu.RLock()
-	defer clus.mmu.RUnlock()
-
-	clus.Members[i].statusLock.Lock()
-	stopped = clus.Members[i].status.State == clusterpb.StoppedMemberStatus
-	clus.Members[i].statusLock.Unlock()
-	return stopped
-}
-
 // Size returns the size of cluster.
 func (clus *Cluster) Size() int {
 	clus.mmu.RLock()
@@ -133,28 +155,126 @@ func (clus *Cluster) ActiveNodeN() (cnt int) {
 	return
 }
 
-// MemberStatus returns the node status.
-func (clus *Cluster) MemberStatus(i int) clusterpb.MemberStatus {
-	return clus.Members[i].status
+// MemberStatus returns the status of the node by its name or ID.
+func (clus *Cluster) MemberStatus(key string) (clusterpb.MemberStatus, error) {
+	m, err := clus.Member(key)
+	if err != nil {
+		return clusterpb.MemberStatus{}, err
+	}
+	return m.Status(), nil
 }
 
-// AllMemberStatus returns all node status.
+// AllMemberStatus returns all node status, as of the same UpdateMemberStatus.
 func (clus *Cluster) AllMemberStatus() []clusterpb.MemberStatus {
 	clus.mmu.RLock()
 	defer clus.mmu.RUnlock()
 
+	clus.statusMu.RLock()
+	defer clus.statusMu.RUnlock()
+
 	st := make([]clusterpb.MemberStatus, clus.size)
 	for i := range clus.Members {
-		st[i] = clus.Members[i].status
+		st[i] = clus.Members[i].Status()
 	}
 	return st
 }
 
-// FindIndex returns the node index by client URL. It returns -1 if none.
-func (clus *Cluster) FindIndex(ep string) int {
-	idx, ok := clus.clientHostToIndex[getHost(ep)]
+// AllMembers returns a snapshot of member handles, which is safe
+// to use while Members are added or removed.
+func (clus *Cluster) AllMembers() []*Member {
+	clus.mmu.RLock()
+	defer clus.mmu.RUnlock()
+
+	ms := make([]*Member, len(clus.Members))
+	copy(ms, clus.Members)
+	return ms
+}
+
+// member returns the member by its name or ID (in hex).
+func (clus *Cluster) member(key string) (*Member, error) {
+	for _, m := range clus.Members {
+		if m.cfg.Name == key {
+			return m, nil
+		}
+		if id := m.ID(); id != 0 && id.String() == key {
+			return m, nil
+		}
+	}
+	return nil, ErrMemberNotFound
+}
+
+// Member returns the member handle by its name or ID (in hex).
+// The handle stays valid while other members are added or removed.
+func (clus *Cluster) Member(key string) (*Member, error) {
+	clus.mmu.RLock()
+	defer clus.mmu.RUnlock()
+	return clus.member(key)
+}
+
+// FindMember returns the member handle by client URL.
+func (clus *Cluster) FindMember(ep string) (*Member, error) {
+	clus.mmu.RLock()
+	defer clus.mmu.RUnlock()
+
+	m, ok := clus.clientHostToMember[getHost(ep)]
 	if !ok {
-		return -1
+		return nil, ErrMemberNotFound
+	}
+	return m, nil
+}
+
+// Leader returns the leader found by the last WaitForLeader.
+func (clus *Cluster) Leader() (*Member, error) {
+	clus.mmu.RLock()
+	defer clus.mmu.RUnlock()
+
+	if clus.lead == nil {
+		return nil, ErrMemberNotFound
+	}
+	return clus.lead, nil
+}
+
+// leaderIndex waits until a member other than 'except' reports itself
+// as the leader, and returns its raft index. It must be called with 'mmu' locked.
+func (clus *Cluster) leaderIndex(ctx context.Context, except *Member) (uint64, error) {
+	for {
+		for _, m := range clus.Members {
+			if m == except || m.IsStopped() {
+				continue
+			}
+			sctx, scancel := context.WithTimeout(ctx, time.Second)
+			resp, err := m.raftStatus(sctx)
+			scancel()
+			if err == nil && resp.Leader == resp.Header.MemberId {
+				return resp.RaftIndex, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ErrTimeout
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// waitForCatchUp waits until the member's raft index reaches
+// the leader's raft index. It must be called with 'mmu' locked.
+func (clus *Cluster) waitForCatchUp(ctx context.Context, m *Member) error {
+	target, err := clus.leaderIndex(ctx, m)
+	if err != nil {
+		return err
+	}
+	for {
+		sctx, scancel := context.WithTimeout(ctx, time.Second)
+		resp, err := m.raftStatus(sctx)
+		scancel()
+		if err == nil && resp.RaftIndex >= target {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ErrTimeout
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
-	return idx
 }
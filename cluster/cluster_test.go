@@ -4,12 +4,16 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/etcd-io/etcdlabs/cluster/clusterpb"
+
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/pkg/transport"
 )
@@ -98,6 +102,55 @@ func TestCluster_Recover_peer_client_manual_TLS_scheme(t *testing.T) {
 	testCluster(t, Config{EmbeddedClient: true, Size: 3, PeerTLSInfo: testTLS, ClientTLSInfo: testTLS}, true, true)
 }
 
+func TestStart_max_size(t *testing.T) {
+	for _, cfg := range []Config{
+		{Size: 0},
+		{Size: DefaultMaxSize + 1},
+		{Size: 10, MaxSize: 9},
+	} {
+		if _, err := Start(context.Background(), cfg); err == nil {
+			t.Fatalf("expected error for size %d (max %d)", cfg.Size, cfg.MaxSize)
+		}
+	}
+}
+
+// TestStart_abort starts a cluster whose last member cannot listen,
+// and expects the started members to be shut down.
+func TestStart_abort(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cluster-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := int(atomic.AddUint32(&basePort, 10))
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port+4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	rootCtx, rootCancel := context.WithCancel(context.Background())
+	defer rootCancel()
+	ctx, cancel := context.WithTimeout(rootCtx, 30*time.Second)
+	_, err = Start(ctx, Config{Size: 3, RootDir: dir, RootPort: port, EmbeddedClient: true, RootCtx: rootCtx, RootCancel: rootCancel})
+	cancel()
+	if err == nil {
+		t.Fatal("expected error with the port in use")
+	}
+	if rootCtx.Err() == nil {
+		t.Fatal("expected the root context canceled")
+	}
+	for _, p := range []int{port, port + 2} {
+		pln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", p))
+		if err != nil {
+			t.Fatalf("expected the port of the started member released (%v)", err)
+		}
+		pln.Close()
+	}
+	if existFileOrDir(dir) {
+		t.Fatalf("expected %q deleted", dir)
+	}
+}
+
 func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 	dir, err := ioutil.TempDir(os.TempDir(), "cluster-test")
 	if err != nil {
@@ -119,7 +172,7 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 	println()
 	println()
 	fmt.Println("starting cluster")
-	c, err := Start(cfg)
+	c, err := Start(cfg.RootCtx, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -128,7 +181,11 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 		println()
 		println()
 		fmt.Println("shutting down the cluster")
-		c.Shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := c.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+		cancel()
 	}()
 
 	ks := []keyValue{
@@ -162,7 +219,7 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 	println()
 	println()
 	fmt.Println("calling UpdateMemberStatus")
-	c.UpdateMemberStatus()
+	c.UpdateMemberStatus(context.Background())
 	hashes1 := make([]uint32, len(c.Members))
 	for i := range c.Members {
 		hashes1[i] = c.Members[i].status.Hash
@@ -173,24 +230,46 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 		println()
 		println()
 		fmt.Println("stopping leader")
-		leadidx := c.LeadIdx
-		c.Stop(leadidx)
+		lead, err := c.Leader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pcli, err := lead.PooledClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cli, _ := lead.PooledClient(); cli != pcli {
+			t.Fatal("expected the same pooled client")
+		}
+		if err := c.Stop(context.Background(), lead.ID().String()); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Stop(context.Background(), lead.Name()); err != ErrMemberStopped {
+			t.Fatalf("expected %v, got %v", ErrMemberStopped, err)
+		}
 		time.Sleep(5 * time.Second)
 
-		if err := c.WaitForLeader(); err != nil {
+		if err := c.WaitForLeader(context.Background()); err != nil {
 			t.Fatal(err)
 		}
+		c.UpdateMemberStatus(context.Background())
+		if st := lead.Status(); st.State != clusterpb.StoppedMemberStatus {
+			t.Fatalf("expected %q, got %q", clusterpb.StoppedMemberStatus, st.State)
+		}
 
 		println()
 		println()
 		println()
 		fmt.Println("recovering old leader")
-		if err = c.Restart(leadidx); err != nil {
+		if err = c.Restart(context.Background(), lead.Name()); err != nil {
 			t.Fatal(err)
 		}
+		if cli, _ := lead.PooledClient(); cli == pcli {
+			t.Fatal("expected a new pooled client after restart")
+		}
 		time.Sleep(5 * time.Second)
 
-		if err := c.WaitForLeader(); err != nil {
+		if err := c.WaitForLeader(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -199,7 +278,7 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 	println()
 	println()
 	fmt.Println("calling UpdateMemberStatus")
-	c.UpdateMemberStatus()
+	c.UpdateMemberStatus(context.Background())
 	hashes2 := make([]uint32, len(c.Members))
 	for i := range c.Members {
 		hashes2[i] = c.Members[i].status.Hash
@@ -241,7 +320,7 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 	println()
 	println()
 	fmt.Println("calling UpdateMemberStatus")
-	c.UpdateMemberStatus()
+	c.UpdateMemberStatus(context.Background())
 	hashes3 := make([]uint32, len(c.Members))
 	for i := range c.Members {
 		hashes3[i] = c.Members[i].status.Hash
@@ -250,16 +329,41 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 		t.Fatalf("hashes1 %v != hashes3 %v", hashes1, hashes3)
 	}
 
+	func() {
+		println()
+		println()
+		println()
+		fmt.Println("adding a new member with canceled context")
+		size := c.Size()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := c.Add(ctx)
+		merr, ok := err.(*MembershipError)
+		if !ok {
+			t.Fatalf("expected *MembershipError, got %v", err)
+		}
+		if merr.Stage != StageMemberAdd || merr.Err != ErrTimeout || merr.RollbackErr != nil {
+			t.Fatalf("unexpected membership error %+v", merr)
+		}
+		if c.Size() != size {
+			t.Fatalf("expected size %d after rollback, got %d", size, c.Size())
+		}
+		if _, err = c.Member(merr.Member); err != ErrMemberNotFound {
+			t.Fatalf("expected %v, got %v", ErrMemberNotFound, err)
+		}
+	}()
+
+	var added *Member
 	func() {
 		println()
 		println()
 		println()
 		fmt.Println("adding a new member")
-		if err := c.Add(); err != nil {
+		if added, err = c.Add(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 		fmt.Println("added a new member")
-		if err := c.WaitForLeader(); err != nil {
+		if err := c.WaitForLeader(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 	}()
@@ -275,18 +379,68 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 
 	func() {
 		time.Sleep(10 * time.Second)
-		if err := c.WaitForLeader(); err != nil {
+		if err := c.WaitForLeader(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 		println()
 		println()
 		println()
 		fmt.Println("removing the member")
-		leadidx := c.LeadIdx
-		if err := c.Remove(leadidx); err != nil {
+		lead, err := c.Leader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Remove(context.Background(), lead.Name()); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.WaitForLeader(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Member(lead.Name()); err != ErrMemberNotFound {
+			t.Fatalf("expected %v, got %v", ErrMemberNotFound, err)
+		}
+		if lead != added {
+			m, err := c.Member(added.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m != added {
+				t.Fatalf("expected handle %q to stay valid after remove", added.Name())
+			}
+		}
+	}()
+
+	func() {
+		println()
+		println()
+		println()
+		fmt.Println("replacing a member")
+		old := c.Members[0]
+		bc, err := c.BalancedClient(old.Endpoints(false)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := c.Replace(context.Background(), old.Name())
+		if err != nil {
 			t.Fatal(err)
 		}
-		if err := c.WaitForLeader(); err != nil {
+		nbc, err := c.BalancedClient(m.Endpoints(false)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nbc == bc {
+			t.Fatal("expected the balanced client of the replaced member to be closed")
+		}
+		if m.Name() != old.Name() {
+			t.Fatalf("expected name %q, got %q", old.Name(), m.Name())
+		}
+		if m.ID() == old.ID() {
+			t.Fatalf("expected new member ID, got same %s", old.ID())
+		}
+		if !reflect.DeepEqual(m.Endpoints(true), old.Endpoints(true)) {
+			t.Fatalf("expected endpoints %v, got %v", old.Endpoints(true), m.Endpoints(true))
+		}
+		if err := c.WaitForLeader(context.Background()); err != nil {
 			t.Fatal(err)
 		}
 	}()
@@ -298,3 +452,125 @@ func testCluster(t *testing.T, cfg Config, scheme, stopRecover bool) {
 		fmt.Printf("Member Status: %q, %+v\n", c.Members[i].cfg.Name, st)
 	}
 }
+
+/*
+go test -v -race -gcflags=all=-d=checkptr=0 -run TestCluster_concurrent
+*/
+
+// TestCluster_concurrent runs membership, stop/restart, client and
+// status calls in parallel; run with '-race' to check data races.
+// Disable checkptr as above, since '-race' enables it, and the vendored
+// bbolt fails its pointer checks (bucket.go) on recent Go versions.
+func TestCluster_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "cluster-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCtx, rootCancel := context.WithCancel(context.Background())
+	defer rootCancel()
+	cfg := Config{
+		EmbeddedClient: true,
+		Size:           3,
+		RootDir:        dir,
+		RootPort:       int(atomic.AddUint32(&basePort, 10)),
+		RootCtx:        rootCtx,
+		RootCancel:     rootCancel,
+	}
+	c, err := Start(rootCtx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := c.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+		cancel()
+	}()
+
+	donec := make(chan struct{})
+	var wg sync.WaitGroup
+	loop := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-donec:
+					return
+				default:
+				}
+				f()
+			}
+		}()
+	}
+
+	loop(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		m, err := c.Add(ctx)
+		if err != nil {
+			t.Logf("add failed (%v)", err)
+			return
+		}
+		c.WaitForLeader(ctx)
+		if err = c.Remove(ctx, m.Name()); err != nil {
+			t.Logf("remove failed (%v)", err)
+		}
+		c.WaitForLeader(ctx)
+	})
+	loop(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.Stop(ctx, "node1"); err != nil {
+			t.Logf("stop failed (%v)", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+		if err := c.Restart(ctx, "node1"); err != nil {
+			t.Logf("restart failed (%v)", err)
+		}
+		c.WaitForLeader(ctx)
+	})
+	loop(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c.UpdateMemberStatus(ctx)
+		cancel()
+		c.AllMemberStatus()
+		time.Sleep(100 * time.Millisecond)
+	})
+	loop(func() {
+		for _, ep := range c.AllEndpoints(false) {
+			cli, err := c.PooledClient(ep)
+			if err != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			cli.Put(ctx, "foo", "bar")
+			cancel()
+		}
+		c.SetClientDialTimeout(time.Second)
+	})
+	loop(func() {
+		for _, m := range c.AllMembers() {
+			m.Name()
+			m.ID()
+			m.Status()
+			m.IsStopped()
+			m.StoppedStartedAt()
+			m.Config()
+			m.Endpoints(true)
+			c.MemberStatus(m.Name())
+		}
+		c.Size()
+		c.Quorum()
+		c.ActiveNodeN()
+		c.AllConfigs()
+		c.InitialCluster()
+		c.Leader()
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	time.Sleep(20 * time.Second)
+	close(donec)
+	wg.Wait()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,44 +23,161 @@ import (
 // Member contains *embed.Etcd and its state.
 type Member struct {
 	clus *Cluster
-	cfg  *embed.Config
-	srv  *embed.Etcd
 
+	// mu protects 'srv', 'stoppedStartedAt' and the fields of 'cfg'
+	// that change after creation (cluster state, initial cluster, TLS).
+	// Name and URLs never change, and can be read without the lock.
+	mu               sync.RWMutex
+	cfg              *embed.Config
+	srv              *embed.Etcd
 	stoppedStartedAt time.Time
 
 	statusLock sync.RWMutex
 	status     clusterpb.MemberStatus
+
+	// connMu protects the connection pool, which is closed
+	// when the member is stopped, restarted or removed
+	connMu     sync.Mutex
+	clients    map[string]*clientv3.Client // keyed by endpoints
+	statusConn *grpc.ClientConn            // for FetchMemberStatus
 }
 
-// Start starts the member.
-func (m *Member) Start() error {
-	srv, err := embed.StartEtcd(m.cfg)
+func newMember(clus *Cluster, cfg *embed.Config) *Member {
+	return &Member{
+		clus: clus,
+		cfg:  cfg,
+		status: clusterpb.MemberStatus{
+			Name:     cfg.Name,
+			Endpoint: cfg.LCUrls[0].String(),
+			IsLeader: false,
+			State:    clusterpb.StoppedMemberStatus,
+		},
+	}
+}
+
+// Name returns the name of the member.
+func (m *Member) Name() string {
+	return m.cfg.Name
+}
+
+// ID returns the raft member ID. It returns 0 if the member has never started.
+func (m *Member) ID() types.ID {
+	srv := m.server()
+	if srv == nil {
+		return 0
+	}
+	return srv.Server.ID()
+}
+
+// server returns the embedded server of the last (re)start.
+func (m *Member) server() *embed.Etcd {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.srv
+}
+
+// Status returns the last fetched status of the member.
+func (m *Member) Status() clusterpb.MemberStatus {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.status
+}
+
+// IsStopped returns true if the member has stopped.
+func (m *Member) IsStopped() bool {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.status.State == clusterpb.StoppedMemberStatus
+}
+
+// StoppedStartedAt returns the member's last stop and (re)start action time.
+func (m *Member) StoppedStartedAt() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.stoppedStartedAt
+}
+
+func (m *Member) setStoppedStartedAt(t time.Time) {
+	m.mu.Lock()
+	m.stoppedStartedAt = t
+	m.mu.Unlock()
+}
+
+// Config returns the configuration of the member.
+func (m *Member) Config() embed.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return *m.cfg
+}
+
+func (m *Member) setInitialCluster(s string) {
+	m.mu.Lock()
+	m.cfg.InitialCluster = s
+	m.mu.Unlock()
+}
+
+// startEtcd starts the embedded server with a copy of the configuration,
+// since embed.StartEtcd modifies it, and publishes the server.
+func (m *Member) startEtcd() (*embed.Etcd, error) {
+	cfg := m.Config()
+	srv, err := embed.StartEtcd(&cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	m.srv = srv
 
-	// copy and overwrite with internal configuration
+	// overwrite with internal configuration
 	// in case it was configured with auto TLS
-	nc := m.srv.Config()
-	m.cfg = &nc
+	nc := srv.Config()
+
+	m.mu.Lock()
+	m.srv = srv
+	m.cfg.ClientTLSInfo = nc.ClientTLSInfo
+	m.cfg.PeerTLSInfo = nc.PeerTLSInfo
+	m.mu.Unlock()
+	return srv, nil
+}
+
+// Endpoints returns the client endpoints of the member.
+func (m *Member) Endpoints(scheme bool) []string {
+	var eps []string
+	for _, ep := range m.cfg.LCUrls {
+		if scheme {
+			eps = append(eps, ep.String())
+		} else {
+			eps = append(eps, ep.Host)
+		}
+	}
+	return eps
+}
+
+// Start starts the member.
+func (m *Member) Start(ctx context.Context) error {
+	srv, err := m.startEtcd()
+	if err != nil {
+		return err
+	}
 
 	var rerr error
 	select {
-	case <-m.srv.Server.ReadyNotify():
-	case rerr = <-m.srv.Err():
-	case <-m.srv.Server.StopNotify():
+	case <-srv.Server.ReadyNotify():
+	case rerr = <-srv.Err():
+	case <-srv.Server.StopNotify():
 		rerr = fmt.Errorf("received from etcdserver.Server.StopNotify")
+	case <-ctx.Done():
+		rerr = ErrTimeout
 	}
 	if rerr != nil {
+		// do not leave a half-started server behind
+		srv.Close()
 		return rerr
 	}
 
-	m.stoppedStartedAt = time.Now()
+	now := time.Now()
+	m.setStoppedStartedAt(now)
 
 	m.statusLock.Lock()
 	m.status.State = clusterpb.FollowerMemberStatus
-	m.status.StateTxt = fmt.Sprintf("%s just started (%s)", m.status.Name, humanize.Time(m.stoppedStartedAt))
+	m.status.StateTxt = fmt.Sprintf("%s just started (%s)", m.status.Name, humanize.Time(now))
 	m.status.IsLeader = false
 	m.statusLock.Unlock()
 
@@ -68,8 +186,12 @@ func (m *Member) Start() error {
 }
 
 // Restart restarts the member.
-func (m *Member) Restart() error {
-	lg.Infof("restarting %q(%s)", m.cfg.Name, m.srv.Server.ID().String())
+func (m *Member) Restart(ctx context.Context) error {
+	lg.Infof("restarting %q(%s)", m.cfg.Name, m.ID().String())
+
+	if ctx.Err() != nil {
+		return ErrTimeout
+	}
 
 	m.statusLock.RLock()
 	if m.status.State != clusterpb.StoppedMemberStatus {
@@ -79,67 +201,88 @@ func (m *Member) Restart() error {
 	}
 	m.statusLock.RUnlock()
 
+	m.mu.Lock()
 	m.cfg.ClusterState = embed.ClusterStateFlagExisting
+	m.mu.Unlock()
+
+	// pooled embedded clients are bound to the previous server
+	m.closeConns()
 
 	// start server
-	srv, err := embed.StartEtcd(m.cfg)
+	srv, err := m.startEtcd()
 	if err != nil {
 		return err
 	}
-	m.srv = srv
-
-	nc := m.srv.Config()
-	m.cfg = &nc
 
 	// this blocks when quorum is lost
-	// <-m.srv.Server.ReadyNotify()
+	// <-srv.Server.ReadyNotify()
 
-	m.stoppedStartedAt = time.Now()
+	now := time.Now()
+	m.setStoppedStartedAt(now)
 
 	m.statusLock.Lock()
 	m.status.IsLeader = false
 	m.status.State = clusterpb.FollowerMemberStatus
-	m.status.StateTxt = fmt.Sprintf("%s just restarted (%s)", m.status.Name, humanize.Time(m.stoppedStartedAt))
+	m.status.StateTxt = fmt.Sprintf("%s just restarted (%s)", m.status.Name, humanize.Time(now))
 	m.statusLock.Unlock()
 
-	lg.Infof("restarted %q(%s)", m.cfg.Name, m.srv.Server.ID().String())
+	lg.Infof("restarted %q(%s)", m.cfg.Name, srv.Server.ID().String())
 	return nil
 }
 
-// Stop stops the member.
-func (m *Member) Stop() {
-	lg.Infof("stopping %q(%s)", m.cfg.Name, m.srv.Server.ID().String())
+// Stop stops the member. It returns ErrMemberStopped if the member
+// is already stopped, and ErrTimeout if the embedded server does not
+// shut down before the context is done.
+func (m *Member) Stop(ctx context.Context) error {
+	srv := m.server()
+	if srv == nil {
+		return ErrMemberStopped
+	}
+	lg.Infof("stopping %q(%s)", m.cfg.Name, srv.Server.ID().String())
 
 	m.statusLock.RLock()
 	if m.status.State == clusterpb.StoppedMemberStatus {
 		lg.Warnf("%s is already stopped", m.cfg.Name)
 		m.statusLock.RUnlock()
-		return
+		return ErrMemberStopped
 	}
 	m.statusLock.RUnlock()
 
-	m.stoppedStartedAt = time.Now()
+	now := time.Now()
+	m.setStoppedStartedAt(now)
 
 	m.statusLock.Lock()
 	m.status.IsLeader = false
 	m.status.State = clusterpb.StoppedMemberStatus
-	m.status.StateTxt = fmt.Sprintf("%s just stopped (%s)", m.status.Name, humanize.Time(m.stoppedStartedAt))
+	m.status.StateTxt = fmt.Sprintf("%s just stopped (%s)", m.status.Name, humanize.Time(now))
 	m.status.DBSize = 0
 	m.status.DBSizeTxt = ""
 	m.status.Hash = 0
 	m.statusLock.Unlock()
 
 	// TODO: stop with/without leadership transfer?
-	// m.srv.Server.HardStop()
+	// srv.Server.HardStop()
+
+	m.closeConns()
 
 	// stops embedded server to trigger
 	// gRPC server graceful shutdown
-	m.srv.Close()
+	closec := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closec)
+	}()
+	select {
+	case <-closec:
+	case <-ctx.Done():
+		lg.Warnf("timed out stopping %q(%s)", m.cfg.Name, srv.Server.ID().String())
+		return ErrTimeout
+	}
 
 	var cerr error
 	select {
-	case cerr = <-m.srv.Err():
-	case <-m.srv.Server.StopNotify():
+	case cerr = <-srv.Err():
+	case <-srv.Server.StopNotify():
 		cerr = fmt.Errorf("received from EtcdServer.StopNotify")
 	}
 	if cerr != nil {
@@ -147,66 +290,86 @@ func (m *Member) Stop() {
 	} else {
 		lg.Infof("shutdown with no error")
 	}
-	lg.Infof("stopped %q(%s)", m.cfg.Name, m.srv.Server.ID().String())
+	lg.Infof("stopped %q(%s)", m.cfg.Name, srv.Server.ID().String())
+	return nil
 }
 
 // WaitForLeader waits for the member to find a leader.
-func (m *Member) WaitForLeader() error {
-	m.statusLock.Lock()
+// It returns ErrMemberStopped if the member is (or gets) stopped,
+// and ErrTimeout if no leader is found before the context is done.
+func (m *Member) WaitForLeader(ctx context.Context) error {
+	m.statusLock.RLock()
 	stopped := m.status.State == clusterpb.StoppedMemberStatus
-	m.statusLock.Unlock()
+	m.statusLock.RUnlock()
 	if stopped {
-		return nil
+		return ErrMemberStopped
 	}
 
 	possibleLead := m.clus.allMemberIDs()
+	srv := m.server()
 
-	cli, _, err := m.Client(false)
+	cli, err := m.PooledClient()
 	if err != nil {
 		return err
 	}
-	defer cli.Close()
+
+	// wait returns an error if the member has stopped or the context is done.
+	wait := func(d time.Duration) error {
+		select {
+		case <-srv.Server.StopNotify():
+			return ErrMemberStopped
+		case <-ctx.Done():
+			return ErrTimeout
+		case <-time.After(d):
+			return nil
+		}
+	}
 
 	for {
 		// ensure leader is up via linearizable get
-		ctx, cancel := context.WithTimeout(m.clus.rootCtx, 3*time.Second)
-		_, err = cli.Get(ctx, "0")
-		cancel()
+		gctx, gcancel := context.WithTimeout(ctx, 3*time.Second)
+		_, err = cli.Get(gctx, "0")
+		gcancel()
 		if err == nil {
 			break
 		}
 		lg.Warn(err)
+		if werr := wait(0); werr != nil {
+			return werr
+		}
 	}
 
 	for {
 		var lead uint64
 		for lead == 0 || !possibleLead[lead] {
-			lead = 0
-			select {
-			case <-m.srv.Server.StopNotify():
-				continue
-			default:
+			if werr := wait(time.Second); werr != nil {
+				return werr
 			}
-			lead = m.srv.Server.Lead()
-			time.Sleep(time.Second)
+			lead = srv.Server.Lead()
 		}
 
-		ctx, cancel := context.WithTimeout(m.clus.rootCtx, 3*time.Second)
-		resp, err := cli.Status(ctx, m.cfg.LCUrls[0].Host)
-		cancel()
+		sctx, scancel := context.WithTimeout(ctx, 3*time.Second)
+		resp, err := cli.Status(sctx, m.cfg.LCUrls[0].Host)
+		scancel()
 		if err != nil {
 			lg.Warn(err)
-			time.Sleep(time.Second)
+			if werr := wait(time.Second); werr != nil {
+				return werr
+			}
 			continue
 		}
 
+		m.statusLock.Lock()
 		m.status.ID = types.ID(resp.Header.MemberId).String()
 
 		if resp.Leader == uint64(0) {
 			lg.Infof("%s %s has no leader yet", m.cfg.Name, types.ID(resp.Header.MemberId))
 			m.status.IsLeader = false
 			m.status.State = clusterpb.FollowerMemberStatus
-			time.Sleep(time.Second)
+			m.statusLock.Unlock()
+			if werr := wait(time.Second); werr != nil {
+				return werr
+			}
 			continue
 		}
 
@@ -217,6 +380,7 @@ func (m *Member) WaitForLeader() error {
 		} else {
 			m.status.State = clusterpb.FollowerMemberStatus
 		}
+		m.statusLock.Unlock()
 
 		if lead == resp.Leader {
 			break
@@ -230,11 +394,12 @@ func (m *Member) WaitForLeader() error {
 // If 'embedded' is true, it ignores 'scheme' and 'eps' arguments,
 // since it directly connects to a single embedded server.
 func (m *Member) Client(scheme bool, eps ...string) (cli *clientv3.Client, tlsCfg *tls.Config, err error) {
+	cfg := m.Config()
 	if m.clus.embeddedClient {
-		cli = v3client.New(m.srv.Server)
+		cli = v3client.New(m.server().Server)
 		if !m.clus.ccfg.ClientTLSInfo.Empty() || m.clus.ccfg.ClientAutoTLS {
 			if tlsCfg == nil {
-				tlsCfg, err = m.cfg.ClientTLSInfo.ClientConfig()
+				tlsCfg, err = cfg.ClientTLSInfo.ClientConfig()
 			}
 		}
 		return cli, tlsCfg, err
@@ -246,13 +411,13 @@ func (m *Member) Client(scheme bool, eps ...string) (cli *clientv3.Client, tlsCf
 	}
 	ccfg := clientv3.Config{
 		Endpoints:   []string{ep},
-		DialTimeout: m.clus.clientDialTimeout,
+		DialTimeout: m.clus.dialTimeout(),
 	}
 	if len(eps) != 0 {
 		ccfg.Endpoints = eps
 	}
-	if !m.cfg.ClientTLSInfo.Empty() {
-		tlsCfg, err = m.cfg.ClientTLSInfo.ClientConfig()
+	if !cfg.ClientTLSInfo.Empty() {
+		tlsCfg, err = cfg.ClientTLSInfo.ClientConfig()
 		if err != nil {
 			return cli, tlsCfg, err
 		}
@@ -262,29 +427,118 @@ func (m *Member) Client(scheme bool, eps ...string) (cli *clientv3.Client, tlsCf
 	return cli, tlsCfg, err
 }
 
-// FetchMemberStatus fetches member status (make sure to close the client outside of this function).
-func (m *Member) FetchMemberStatus() error {
-	cli, tlsCfg, err := m.Client(false)
+// PooledClient returns the cached client of the member, creating one
+// if needed. 'eps' overwrites the endpoints as in Client. The client is
+// shared, so callers must not close it; it is closed when the member
+// is stopped, restarted or removed.
+func (m *Member) PooledClient(eps ...string) (*clientv3.Client, error) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	key := strings.Join(eps, ",")
+	if m.clus.embeddedClient {
+		key = "" // embedded clients ignore endpoints
+	}
+	if cli, ok := m.clients[key]; ok {
+		return cli, nil
+	}
+	cli, _, err := m.Client(false, eps...)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if m.clients == nil {
+		m.clients = make(map[string]*clientv3.Client)
+	}
+	m.clients[key] = cli
+	return cli, nil
+}
+
+// raftStatus returns the status of the member via its own client.
+func (m *Member) raftStatus(ctx context.Context) (*clientv3.StatusResponse, error) {
+	cli, err := m.PooledClient()
+	if err != nil {
+		return nil, err
+	}
+	return cli.Status(ctx, m.cfg.LCUrls[0].Host)
+}
+
+// statusClient returns the maintenance client for status polling.
+// gRPC reconnects the underlying connection when the member restarts.
+func (m *Member) statusClient() (pb.MaintenanceClient, error) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	if m.statusConn == nil {
+		var dopts = []grpc.DialOption{}
+		if cfg := m.Config(); !cfg.ClientTLSInfo.Empty() || m.clus.ccfg.ClientAutoTLS {
+			tlsCfg, err := cfg.ClientTLSInfo.ClientConfig()
+			if err != nil {
+				return nil, err
+			}
+			dopts = append(dopts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
+		} else {
+			dopts = append(dopts, grpc.WithInsecure())
+		}
+		conn, err := grpc.Dial(m.cfg.LCUrls[0].Host, dopts...)
+		if err != nil {
+			return nil, err
+		}
+		m.statusConn = conn
+	}
+	return pb.NewMaintenanceClient(m.statusConn), nil
+}
+
+// closeConns closes all pooled clients and the status connection.
+func (m *Member) closeConns() {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+
+	for key, cli := range m.clients {
+		cli.Close()
+		delete(m.clients, key)
+	}
+	if m.statusConn != nil {
+		m.statusConn.Close()
+		m.statusConn = nil
 	}
-	defer cli.Close()
+}
+
+// unreachableStatus returns the status of the member marked unreachable.
+func (m *Member) unreachableStatus(reason string, at time.Time, err error) clusterpb.MemberStatus {
+	st := m.Status()
+	st.State = clusterpb.StoppedMemberStatus
+	st.StateTxt = fmt.Sprintf("%s %s (%s - %v)", st.Name, reason, humanize.Time(at), err)
+	st.IsLeader = false
+	st.DBSize = 0
+	st.DBSizeTxt = ""
+	st.Hash = 0
+	return st
+}
+
+// FetchMemberStatus fetches member status over the reused status connection.
+func (m *Member) FetchMemberStatus(ctx context.Context) error {
+	st, err := m.fetchStatus(ctx)
+	m.statusLock.Lock()
+	m.status = st
+	m.statusLock.Unlock()
+	return err
+}
 
+// fetchStatus fetches member status without updating the member.
+// On error, it returns the status marked unreachable.
+func (m *Member) fetchStatus(ctx context.Context) (clusterpb.MemberStatus, error) {
 	now := time.Now()
 
-	ctx, cancel := context.WithTimeout(m.clus.rootCtx, time.Second)
-	resp, err := cli.Status(ctx, m.cfg.LCUrls[0].String())
-	cancel()
+	mc, err := m.statusClient()
 	if err != nil {
-		m.statusLock.Lock()
-		m.status.State = clusterpb.StoppedMemberStatus
-		m.status.StateTxt = fmt.Sprintf("%s is not reachable (%s - %v)", m.status.Name, humanize.Time(now), err)
-		m.status.IsLeader = false
-		m.status.DBSize = 0
-		m.status.DBSizeTxt = ""
-		m.status.Hash = 0
-		m.statusLock.Unlock()
-		return err
+		return m.unreachableStatus("is not reachable", now, err), err
+	}
+
+	sctx, scancel := context.WithTimeout(ctx, time.Second)
+	resp, err := mc.Status(sctx, &pb.StatusRequest{})
+	scancel()
+	if err != nil {
+		return m.unreachableStatus("is not reachable", now, err), err
 	}
 
 	isLeader, state := false, clusterpb.FollowerMemberStatus
@@ -297,54 +551,22 @@ func (m *Member) FetchMemberStatus() error {
 		Endpoint:  m.cfg.LCUrls[0].String(),
 		IsLeader:  isLeader,
 		State:     state,
-		StateTxt:  fmt.Sprintf("%s has been healthy (since %s)", m.status.Name, humanize.Time(m.stoppedStartedAt)),
+		StateTxt:  fmt.Sprintf("%s has been healthy (since %s)", m.cfg.Name, humanize.Time(m.StoppedStartedAt())),
 		DBSize:    uint64(resp.DbSize),
 		DBSizeTxt: humanize.Bytes(uint64(resp.DbSize)),
 	}
 
 	now = time.Now()
-	var dopts = []grpc.DialOption{grpc.WithTimeout(time.Second)}
-	if tlsCfg != nil {
-		dopts = append(dopts, grpc.WithTransportCredentials(credentials.NewTLS(tlsCfg)))
-	} else {
-		dopts = append(dopts, grpc.WithInsecure())
-	}
-	conn, err := grpc.Dial(m.cfg.LCUrls[0].Host, dopts...)
-	if err != nil {
-		m.statusLock.Lock()
-		m.status.State = clusterpb.StoppedMemberStatus
-		m.status.StateTxt = fmt.Sprintf("%s is not reachable (%s - %v)", m.status.Name, humanize.Time(now), err)
-		m.status.IsLeader = false
-		m.status.DBSize = 0
-		m.status.DBSizeTxt = ""
-		m.status.Hash = 0
-		m.statusLock.Unlock()
-		return err
-	}
-	defer conn.Close()
-
-	now = time.Now()
-	mc := pb.NewMaintenanceClient(conn)
-
-	ctx, cancel = context.WithTimeout(m.clus.rootCtx, time.Second)
-	var hresp *pb.HashResponse
-	hresp, err = mc.Hash(ctx, &pb.HashRequest{}, grpc.FailFast(false))
-	cancel()
+	hctx, hcancel := context.WithTimeout(ctx, time.Second)
+	// HashKV hashes the keys under the store's lock, while Hash reads the
+	// whole backend racing with applied writes. It is also comparable
+	// across members at the same revision.
+	var hresp *pb.HashKVResponse
+	hresp, err = mc.HashKV(hctx, &pb.HashKVRequest{}, grpc.FailFast(false))
+	hcancel()
 	if err != nil {
-		m.statusLock.Lock()
-		m.status.State = clusterpb.StoppedMemberStatus
-		m.status.StateTxt = fmt.Sprintf("%s was not reachable while getting hash (%s - %v)", m.status.Name, humanize.Time(now), err)
-		m.status.IsLeader = false
-		m.status.DBSize = 0
-		m.status.DBSizeTxt = ""
-		m.status.Hash = 0
-		m.statusLock.Unlock()
-		return err
+		return m.unreachableStatus("was not reachable while getting hash", now, err), err
 	}
 	status.Hash = hresp.Hash
-
-	m.statusLock.Lock()
-	m.status = status
-	m.statusLock.Unlock()
-	return nil
+	return status, nil
 }
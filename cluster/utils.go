@@ -1,11 +1,15 @@
 package cluster
 
 import (
+	"context"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/netutil"
 )
 
 func existFileOrDir(name string) bool {
@@ -37,6 +41,19 @@ func mkdirAll(dir string) error {
 	return dirWritable(dir)
 }
 
+// defaultHost returns the default host, or 'localhost' if none.
+func defaultHost() string {
+	lg.Infof("getting default host")
+	dhost, err := netutil.GetDefaultHost()
+	if err != nil {
+		lg.Warn(err)
+		lg.Warn("overwriting default host with 'localhost")
+		dhost = "localhost"
+	}
+	lg.Infof("detected default host %q", dhost)
+	return dhost
+}
+
 func getHost(ep string) string {
 	url, uerr := url.Parse(ep)
 	if uerr != nil || !strings.Contains(ep, "://") {
@@ -44,3 +61,20 @@ func getHost(ep string) string {
 	}
 	return url.Host
 }
+
+// removeByPeerURL removes the member with the peer URL from raft membership, if any.
+func removeByPeerURL(ctx context.Context, cli *clientv3.Client, purl string) error {
+	resp, err := cli.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range resp.Members {
+		for _, u := range m.PeerURLs {
+			if u == purl {
+				_, err = cli.MemberRemove(ctx, m.ID)
+				return err
+			}
+		}
+	}
+	return nil
+}
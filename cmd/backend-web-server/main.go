@@ -17,11 +17,16 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/etcd-io/etcdlabs/backend/web"
+	"github.com/etcd-io/etcdlabs/cluster"
 
+	"github.com/coreos/etcd/clientv3"
 	_ "github.com/ugorji/go/codec"
 	"go.uber.org/zap"
 )
@@ -29,6 +34,17 @@ import (
 var (
 	webPort         int
 	recordTesterEps string
+
+	clusterSize  int
+	rootPort     int
+	sandbox      bool
+	maxSandboxes int
+	namespace    bool
+
+	clientRequestInterval time.Duration
+	stopRestartInterval   time.Duration
+	rateLimitBurst        int
+	rateLimitEps          string
 )
 
 var lg *zap.SugaredLogger
@@ -43,10 +59,38 @@ func init() {
 
 func main() {
 	flag.IntVar(&webPort, "web-port", 2200, "Specify the web port for backend.")
+	flag.IntVar(&clusterSize, "cluster-size", 0, "Specify the number of members of the cluster (default 5, or 3 for sandboxes).")
+	flag.IntVar(&rootPort, "root-port", 0, "Specify the first port of the cluster (default 2389).")
+	flag.BoolVar(&sandbox, "sandbox", false, "Start a dedicated cluster for each user.")
+	flag.IntVar(&maxSandboxes, "max-sandboxes", 0, "Specify the maximum number of user clusters (default 10).")
+	flag.BoolVar(&namespace, "namespace", false, "Isolate the keys of each user on the shared cluster.")
+	flag.DurationVar(&clientRequestInterval, "client-request-interval", 0, "Specify the minimum interval between client requests of a user.")
+	flag.DurationVar(&stopRestartInterval, "stop-restart-interval", 0, "Specify the minimum interval between node operations of a user.")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 0, "Specify the number of requests a user can make at once.")
+	flag.StringVar(&rateLimitEps, "rate-limit-endpoints", "", "Specify comma-separated etcd endpoints to share the rate limits between servers.")
 	flag.Parse()
 
+	cfg := web.ServerConfig{
+		Addr:                  fmt.Sprintf("localhost:%d", webPort),
+		Cluster:               cluster.Config{Size: clusterSize, RootPort: rootPort, EmbeddedClient: true},
+		Sandbox:               sandbox,
+		MaxSandboxes:          maxSandboxes,
+		Namespace:             namespace,
+		ClientRequestInterval: clientRequestInterval,
+		StopRestartInterval:   stopRestartInterval,
+		RateLimitBurst:        rateLimitBurst,
+	}
+	if rateLimitEps != "" {
+		cli, err := clientv3.New(clientv3.Config{Endpoints: strings.Split(rateLimitEps, ","), DialTimeout: 5 * time.Second})
+		if err != nil {
+			panic(err)
+		}
+		defer cli.Close()
+		cfg.RateLimitClient = cli
+	}
+
 	lg.Info("starting web server")
-	srv, err := web.StartServer(webPort)
+	srv, err := web.StartServer(cfg)
 	if err != nil {
 		panic(err)
 	}
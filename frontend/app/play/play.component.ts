@@ -13,10 +13,11 @@ export class KeyValue {
 }
 
 export class ClientRequest {
-  Action: string; // 'write', 'stress', 'get', 'delete', 'stop-node', 'restart-node'
-  RangePrefix: boolean; // 'get', 'delete'
+  Action: string; // 'write', 'stress', 'get', 'delete', 'watch', 'stop-node', 'restart-node'
+  RangePrefix: boolean; // 'get', 'delete', 'watch'
   Endpoints: string[];
   KeyValue: KeyValue;
+  Balanced: boolean; // connects to all endpoints through the client balancer
 
   constructor(
     act: string,
@@ -38,6 +39,10 @@ export class ClientResponse {
   Result: string;
   ResultLines: string[];
   KeyValues: KeyValue[];
+  MemberName: string; // the member that served the request
+  Endpoint: string;
+  OperationID: string; // 'stop-node', 'restart-node'
+  WatchID: string; // 'watch'
 
   constructor(
     clientRequest: ClientRequest,
@@ -54,6 +59,15 @@ export class ClientResponse {
   }
 }
 
+export class Operation {
+  ID: string;
+  Action: string;
+  Member: string;
+  State: string; // 'queued', 'running', 'done', 'failed'
+  Result: string;
+  Error: string;
+}
+
 export class LogLine {
   index: number;
   logLevel: string;
@@ -99,6 +113,9 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
 
   mode = 'Observable';
   private clientRequestEndpoint = 'client-request';
+  private operationEndpoint = 'operation';
+  private serverStatusStreamEndpoint = 'server-status-stream';
+  private watchEndpoint = 'watch';
 
   logOutputLines: LogLine[];
 
@@ -117,10 +134,13 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
 
   serverStatusErrorMessage: string;
   serverStatusHandler;
+  serverStatusStream: EventSource;
+  watchStreams: EventSource[] = [];
 
   inputKey: string;
   inputValue: string;
   deleteReadByPrefix: boolean;
+  useBalancer: boolean;
 
   clientResponse: ClientResponse;
   clientResponseError: string;
@@ -151,6 +171,7 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
     this.inputKey = '';
     this.inputValue = '';
     this.deleteReadByPrefix = false;
+    this.useBalancer = false;
   }
 
   ngOnInit(): void {
@@ -171,7 +192,7 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
   ngOnDestroy() {
     console.log('Disconnected from cluster (user left the page)!');
     this.closeConnect();
-    clearInterval(this.serverStatusHandler);
+    this.stopServerStatus();
     return;
   }
 
@@ -272,8 +293,13 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
 
     this.connected = true;
 
-    // (X) setInterval(this.getServerStatus, 1000);
-    this.serverStatusHandler = setInterval(() => this.getServerStatus(), 1000);
+    // push server status if supported, otherwise poll
+    if (typeof EventSource !== 'undefined') {
+      this.startServerStatusStream();
+    } else {
+      // (X) setInterval(this.getServerStatus, 1000);
+      this.serverStatusHandler = setInterval(() => this.getServerStatus(), 1000);
+    }
   }
 
   clickDisconnect() {
@@ -287,7 +313,7 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
     this.connected = false;
 
     this.closeConnect();
-    clearInterval(this.serverStatusHandler);
+    this.stopServerStatus();
   }
   ///////////////////////////////////////////////////////
 
@@ -304,10 +330,55 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
 
     if (!this.playgroundActive) {
       this.closeConnect();
-      clearInterval(this.serverStatusHandler);
+      this.stopServerStatus();
     };
   };
 
+  // processServerStatusDiff applies the changed fields to the current status.
+  processServerStatusDiff(diff: any) {
+    let memberStatuses = (this.memberStatuses || []).slice();
+    for (let st of (diff.MemberStatuses || [])) {
+      let idx = memberStatuses.findIndex(m => m.Name === st.Name);
+      if (idx < 0) {
+        memberStatuses.push(st);
+      } else {
+        memberStatuses[idx] = st;
+      }
+    }
+    let removed = diff.RemovedMembers || [];
+    memberStatuses = memberStatuses.filter(m => removed.indexOf(m.Name) < 0);
+
+    let has = (k: string) => diff[k] !== undefined;
+    this.processServerStatusResponse(new ServerStatus(
+      has('PlaygroundActive') ? diff.PlaygroundActive : this.playgroundActive,
+      has('ServerUptime') ? diff.ServerUptime : this.serverUptime,
+      has('ServerVisits') ? diff.ServerVisits : this.serverVisits,
+      has('UserN') ? diff.UserN : this.userN,
+      has('Users') ? diff.Users : this.users,
+      memberStatuses,
+    ));
+  }
+
+  // startServerStatusStream receives server status and cluster events
+  // pushed by backend.
+  startServerStatusStream() {
+    let stream = new EventSource(this.serverStatusStreamEndpoint);
+    stream.addEventListener('status', (e: MessageEvent) => this.processServerStatusResponse(<ServerStatus>JSON.parse(e.data)));
+    stream.addEventListener('status-diff', (e: MessageEvent) => this.processServerStatusDiff(JSON.parse(e.data)));
+    stream.addEventListener('cluster', (e: MessageEvent) => this.sendLogLine('INFO', JSON.parse(e.data).Message));
+    stream.onerror = () => this.serverStatusErrorMessage = 'server status stream error (reconnecting...)';
+    this.serverStatusStream = stream;
+  }
+
+  stopServerStatus() {
+    this.stopWatchStreams();
+    clearInterval(this.serverStatusHandler);
+    if (this.serverStatusStream) {
+      this.serverStatusStream.close();
+      this.serverStatusStream = null;
+    }
+  }
+
   // getServerStatus fetches server status from backend.
   // memberStatus is true to get the status of all nodes.
   getServerStatus() {
@@ -345,7 +416,8 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
         this.deleteResult = this.clientResponse.Result;
         break;
 
-      case 'get':
+      case 'get': // fallthrough
+      case 'watch':
         this.readResult = this.clientResponse.Result;
         break;
     }
@@ -357,6 +429,56 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
         this.sendLogLine(logLevel, this.clientResponse.ResultLines[_i]);
       }
     }
+
+    if (this.clientResponse.OperationID) {
+      this.waitOperation(this.clientResponse.OperationID, 'queued', logLevel);
+    }
+    if (this.clientResponse.WatchID) {
+      this.startWatchStream(this.clientResponse.WatchID);
+    }
+  }
+
+  // startWatchStream logs the events of the watch pushed by backend,
+  // until the watch ends.
+  startWatchStream(id: string) {
+    let stream = new EventSource(this.watchEndpoint + '?id=' + encodeURIComponent(id));
+    stream.addEventListener('watch', (e: MessageEvent) => {
+      let ev = JSON.parse(e.data);
+      this.sendLogLine(ev.Type === 'RECONNECT' ? 'WARN' : 'INFO', ev.Message);
+    });
+    stream.addEventListener('watch-end', (e: MessageEvent) => {
+      let resp = <ClientResponse>JSON.parse(e.data);
+      this.sendLogLine(resp.Success ? 'INFO' : 'WARN', resp.Result);
+      stream.close();
+      this.watchStreams = this.watchStreams.filter(s => s !== stream);
+    });
+    this.watchStreams.push(stream);
+  }
+
+  stopWatchStreams() {
+    for (let stream of this.watchStreams) {
+      stream.close();
+    }
+    this.watchStreams = [];
+  }
+
+  // waitOperation long-polls the operation until it finishes, and logs its result.
+  waitOperation(id: string, state: string, logLevel: string) {
+    let url = this.operationEndpoint + '?id=' + encodeURIComponent(id) + '&wait=' + state;
+    this.http.get(url)
+      .map(res => <Operation>res.json())
+      .subscribe(
+        op => {
+          if (op.State === 'done') {
+            this.sendLogLine(logLevel, op.Result);
+          } else if (op.State === 'failed') {
+            this.sendLogLine('WARN', op.Result);
+          } else {
+            this.waitOperation(id, op.State, logLevel);
+          }
+        },
+        error => this.clientResponseError = <any>error,
+      );
   }
 
   processHTTPResponseClient(res: Response) {
@@ -381,7 +503,13 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
     // this returns without waiting for POST response
     let obser = this.http.post(this.clientRequestEndpoint, body, options)
       .map(this.processHTTPResponseClient)
-      .catch(this.processHTTPErrorClient);
+      .catch(error => {
+        // rate-limited requests still return the client response
+        if (error.status === 429) {
+          return Observable.of(<ClientResponse>error.json());
+        }
+        return this.processHTTPErrorClient(error);
+      });
     return obser;
   }
 
@@ -408,6 +536,7 @@ export class PlayComponent implements OnInit, AfterContentInit, AfterViewChecked
     }
 
     let clientRequest = new ClientRequest(act, prefix, eps, key, val);
+    clientRequest.Balanced = this.useBalancer && act !== 'stop-node' && act !== 'restart-node';
     let clientResponseFromSubscribe: ClientResponse;
     this.postClientRequest(clientRequest).subscribe(
       clientResponse => clientResponseFromSubscribe = clientResponse,
@@ -0,0 +1,320 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/time/rate"
+)
+
+// EtcdConfig configures the KeyedLimiter that stores its state in etcd,
+// so that it is shared by all servers using the same cluster and prefix.
+type EtcdConfig struct {
+	KeyedConfig
+
+	// Client is the client of the etcd cluster storing the state.
+	Client *clientv3.Client
+	// Prefix is the key prefix of the state (e.g. "/ratelimit/client-request/").
+	Prefix string
+	// RequestTimeout is the timeout of each etcd request. Defaults to 1 second.
+	RequestTimeout time.Duration
+
+	// OnError is called when etcd is not available, and the request
+	// is limited by the local limiter instead. It may be nil.
+	OnError func(err error)
+}
+
+const (
+	// etcdMinLeaseTTL is the minimum lease TTL in seconds that etcd grants.
+	etcdMinLeaseTTL = 5
+	// etcdMaxRetries bounds the transaction retries under contention.
+	etcdMaxRetries = 5
+)
+
+// NewEtcdKeyedLimiter returns a new KeyedLimiter whose per-key state is
+// stored in etcd. Each key holds the time when its burst is fully refilled
+// (GCRA), updated by compare-and-swap transactions and expired by leases.
+//
+// The global ceiling is enforced by each server locally, since it
+// protects the server itself. When etcd is not available, the keys are
+// limited locally with the same configuration. The servers' clocks are
+// assumed to be roughly in sync.
+func NewEtcdKeyedLimiter(cfg EtcdConfig) KeyedLimiter {
+	if cfg.Burst == 0 {
+		cfg.Burst = 1
+	}
+	if cfg.GlobalBurst == 0 {
+		cfg.GlobalBurst = 1
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = time.Second
+	}
+
+	lcfg := cfg.KeyedConfig
+	lcfg.GlobalInterval = 0
+	el := &etcdLimiter{
+		cfg:   cfg,
+		local: NewKeyedLimiter(lcfg),
+	}
+	if cfg.GlobalInterval > 0 {
+		el.global = rate.NewLimiter(rate.Every(cfg.GlobalInterval), cfg.GlobalBurst)
+	}
+	return el
+}
+
+// NewEtcdRequestLimiter returns a new RequestLimiter whose state is
+// stored in etcd under the key.
+func NewEtcdRequestLimiter(rootCtx context.Context, cli *clientv3.Client, key string, interval time.Duration) RequestLimiter {
+	return &etcdRequestLimiter{
+		rootCtx: rootCtx,
+		key:     key,
+		el: NewEtcdKeyedLimiter(EtcdConfig{
+			KeyedConfig: KeyedConfig{Interval: interval},
+			Client:      cli,
+		}).(*etcdLimiter),
+	}
+}
+
+type etcdLimiter struct {
+	cfg EtcdConfig
+
+	mu           sync.Mutex
+	lease        clientv3.LeaseID
+	leaseTTL     time.Duration
+	leaseGranted time.Time
+	granting     bool // true while a lease is being granted
+
+	global *rate.Limiter
+	local  KeyedLimiter // used when etcd is not available
+}
+
+func (el *etcdLimiter) Check(key string) (msg string, ok bool) {
+	res := el.Take(key)
+	return res.Message(), res.OK
+}
+
+func (el *etcdLimiter) Allow(key string) (retryAfter time.Duration, ok bool) {
+	res := el.Take(key)
+	return res.RetryAfter, res.OK
+}
+
+func (el *etcdLimiter) Take(key string) Result {
+	now := time.Now()
+
+	// reserve the global token first, since the one in etcd cannot be canceled
+	var gr *rate.Reservation
+	if el.global != nil {
+		gr = el.global.ReserveN(now, 1)
+		if d := gr.DelayFrom(now); d > 0 {
+			gr.CancelAt(now)
+			return Result{Global: true, Limit: el.cfg.Burst, RetryAfter: d}
+		}
+	}
+
+	res, err := el.take(key, now)
+	if err != nil {
+		if el.cfg.OnError != nil && err != errLeaseGranting {
+			el.cfg.OnError(err)
+		}
+		res = el.local.Take(key)
+	}
+	if !res.OK && gr != nil {
+		gr.CancelAt(now)
+	}
+	return res
+}
+
+// take takes a token of the key in etcd.
+func (el *etcdLimiter) take(key string, now time.Time) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), el.cfg.RequestTimeout)
+	defer cancel()
+
+	el.mu.Lock()
+	interval, burst := el.cfg.Interval, el.cfg.Burst
+	el.mu.Unlock()
+	tolerance := interval * time.Duration(burst-1)
+	res := Result{Limit: burst}
+
+	lease, err := el.leaseID(ctx, now)
+	if err != nil {
+		return res, err
+	}
+
+	// assume the key does not exist, which saves a round trip for new keys;
+	// otherwise, the failed transaction returns the current state
+	k := el.cfg.Prefix + key
+	var (
+		tat time.Time
+		rev int64
+	)
+	for i := 0; i < etcdMaxRetries; i++ {
+		if tat.Before(now) {
+			tat = now
+		}
+		if d := tat.Sub(now) - tolerance; d > 0 {
+			res.RetryAfter, res.Reset = d, tat.Sub(now)
+			return res, nil
+		}
+		ntat := tat.Add(interval)
+
+		resp, err := el.cfg.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(k), "=", rev)).
+			Then(clientv3.OpPut(k, strconv.FormatInt(ntat.UnixNano(), 10), clientv3.WithLease(lease))).
+			Else(clientv3.OpGet(k)).
+			Commit()
+		if err != nil {
+			if err == rpctypes.ErrLeaseNotFound {
+				el.forgetLease(lease)
+			}
+			return res, err
+		}
+		if resp.Succeeded {
+			res.OK, res.Reset = true, ntat.Sub(now)
+			if interval <= 0 {
+				res.Remaining = burst
+			} else if res.Reset <= tolerance {
+				res.Remaining = int((tolerance-res.Reset)/interval) + 1
+			}
+			return res, nil
+		}
+
+		tat, rev = time.Time{}, 0
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			tat, rev = parseTAT(kvs[0]), kvs[0].ModRevision
+		}
+	}
+
+	// too many servers are updating the key at once
+	res.RetryAfter, res.Reset = interval, interval*time.Duration(burst)
+	return res, nil
+}
+
+// parseTAT returns the stored time, or zero time if it is malformed.
+func parseTAT(kv *mvccpb.KeyValue) time.Time {
+	ns, err := strconv.ParseInt(string(kv.Value), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// errLeaseGranting is returned while another request is granting the
+// lease, so that the request is limited locally instead of waiting.
+var errLeaseGranting = errors.New("ratelimit: lease is being granted")
+
+// leaseID returns the lease to attach the keys to. A key lives at least
+// until its burst is refilled, since new keys are attached to a lease
+// only in the first half of its TTL, which is twice the refill time.
+// The lock is not held while granting, so that an unavailable etcd
+// does not block the other requests.
+func (el *etcdLimiter) leaseID(ctx context.Context, now time.Time) (clientv3.LeaseID, error) {
+	el.mu.Lock()
+	if el.lease != 0 && now.Sub(el.leaseGranted) < el.leaseTTL/2 {
+		id := el.lease
+		el.mu.Unlock()
+		return id, nil
+	}
+	if el.granting {
+		el.mu.Unlock()
+		return 0, errLeaseGranting
+	}
+	el.granting = true
+	refill := el.cfg.Interval * time.Duration(el.cfg.Burst)
+	el.mu.Unlock()
+
+	ttl := int64(2*refill/time.Second) + 1
+	if ttl < etcdMinLeaseTTL {
+		ttl = etcdMinLeaseTTL
+	}
+	resp, err := el.cfg.Client.Grant(ctx, ttl)
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	el.granting = false
+	if err != nil {
+		return 0, err
+	}
+	// keep the lease only if the refill time has not changed meanwhile
+	if refill == el.cfg.Interval*time.Duration(el.cfg.Burst) {
+		el.lease, el.leaseTTL, el.leaseGranted = resp.ID, time.Duration(resp.TTL)*time.Second, now
+	}
+	return resp.ID, nil
+}
+
+// forgetLease clears the lease if it is still current, after etcd
+// reported it as revoked or expired, so that the next request grants
+// a new one.
+func (el *etcdLimiter) forgetLease(id clientv3.LeaseID) {
+	el.mu.Lock()
+	if el.lease == id {
+		el.lease = 0
+	}
+	el.mu.Unlock()
+}
+
+func (el *etcdLimiter) SetInterval(interval time.Duration) {
+	el.mu.Lock()
+	el.cfg.Interval = interval
+	el.lease = 0 // the refill time may have grown
+	el.mu.Unlock()
+
+	el.local.SetInterval(interval)
+}
+
+// Len returns the number of keys in etcd, or of the local limiter
+// if etcd is not available.
+func (el *etcdLimiter) Len() int {
+	ctx, cancel := context.WithTimeout(context.Background(), el.cfg.RequestTimeout)
+	defer cancel()
+	resp, err := el.cfg.Client.Get(ctx, el.cfg.Prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return el.local.Len()
+	}
+	return int(resp.Count)
+}
+
+type etcdRequestLimiter struct {
+	rootCtx context.Context
+	key     string
+	el      *etcdLimiter
+}
+
+func (rl *etcdRequestLimiter) Check() (msg string, ok bool) {
+	if rl.rootCtx.Err() != nil {
+		return RootContextCanceled, false
+	}
+	return rl.el.Check(rl.key)
+}
+
+func (rl *etcdRequestLimiter) Allow() (retryAfter time.Duration, ok bool) {
+	if rl.rootCtx.Err() != nil {
+		return 0, false
+	}
+	return rl.el.Allow(rl.key)
+}
+
+func (rl *etcdRequestLimiter) Advance() {}
+
+func (rl *etcdRequestLimiter) SetInterval(interval time.Duration) {
+	rl.el.SetInterval(interval)
+}
@@ -0,0 +1,248 @@
+// Copyright 2016 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// KeyedConfig configures KeyedLimiter.
+type KeyedConfig struct {
+	// Interval is the minimum interval between requests of a key.
+	Interval time.Duration
+	// Burst is the number of requests of a key allowed at once.
+	// Defaults to 1.
+	Burst int
+
+	// MaxKeys bounds the number of tracked keys, evicting the least
+	// recently used key. Defaults to 10000.
+	MaxKeys int
+	// TTL evicts the keys idle for longer. It is at least the time to
+	// refill the burst, so that the eviction does not relax the limit.
+	TTL time.Duration
+
+	// GlobalInterval is the minimum interval between requests of all keys.
+	// Zero disables the global ceiling.
+	GlobalInterval time.Duration
+	// GlobalBurst is the number of requests of all keys allowed at once.
+	// Defaults to 1.
+	GlobalBurst int
+}
+
+// KeyedLimiter limits requests per key (e.g. user ID or IP address),
+// under an optional global ceiling.
+type KeyedLimiter interface {
+	// Check returns true if it's ok to request for the key, and counts
+	// the request. Otherwise, it returns the message with the duration
+	// to wait, without counting the request.
+	Check(key string) (msg string, ok bool)
+	// Allow is Check that returns the exact duration to wait, if not ok.
+	Allow(key string) (retryAfter time.Duration, ok bool)
+	// Take is Check that returns the state of the key.
+	Take(key string) Result
+	// SetInterval updates the interval of all keys.
+	SetInterval(interval time.Duration)
+	// Len returns the number of tracked keys.
+	Len() int
+}
+
+// Result is the result of a request of a key.
+type Result struct {
+	// OK is true if the request is allowed.
+	OK bool
+	// Global is true if the request is rejected by the global ceiling.
+	Global bool
+
+	// Limit is the number of requests of the key allowed at once.
+	Limit int
+	// Remaining is the number of requests of the key allowed right away.
+	Remaining int
+	// RetryAfter is the duration to wait, if not OK.
+	RetryAfter time.Duration
+	// Reset is the duration until Limit requests of the key are allowed again.
+	Reset time.Duration
+}
+
+// Message returns OkMessage, or the message with the duration to wait.
+func (r Result) Message() string {
+	switch {
+	case r.OK:
+		return OkMessage
+	case r.Global:
+		return fmt.Sprintf("server is busy (try again after %v)", roundDownDuration(r.RetryAfter, time.Millisecond))
+	default:
+		return fmt.Sprintf("rate limit exceeded (try again after %v)", roundDownDuration(r.RetryAfter, time.Millisecond))
+	}
+}
+
+// NewKeyedLimiter returns a new KeyedLimiter.
+func NewKeyedLimiter(cfg KeyedConfig) KeyedLimiter {
+	if cfg.Burst == 0 {
+		cfg.Burst = 1
+	}
+	if cfg.MaxKeys == 0 {
+		cfg.MaxKeys = 10000
+	}
+	if refill := cfg.Interval * time.Duration(cfg.Burst); cfg.TTL < refill {
+		cfg.TTL = refill
+	}
+	if cfg.GlobalBurst == 0 {
+		cfg.GlobalBurst = 1
+	}
+
+	kl := &keyedLimiter{
+		cfg:  cfg,
+		keys: make(map[string]*list.Element),
+		lru:  list.New(),
+	}
+	if cfg.GlobalInterval > 0 {
+		kl.global = rate.NewLimiter(rate.Every(cfg.GlobalInterval), cfg.GlobalBurst)
+	}
+	return kl
+}
+
+type keyedLimiter struct {
+	mu  sync.Mutex
+	cfg KeyedConfig
+
+	keys map[string]*list.Element
+	lru  *list.List // of *keyedEntry, most recently used first
+
+	global *rate.Limiter
+}
+
+type keyedEntry struct {
+	key      string
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func (kl *keyedLimiter) Check(key string) (msg string, ok bool) {
+	res := kl.Take(key)
+	return res.Message(), res.OK
+}
+
+func (kl *keyedLimiter) Allow(key string) (retryAfter time.Duration, ok bool) {
+	res := kl.Take(key)
+	return res.RetryAfter, res.OK
+}
+
+func (kl *keyedLimiter) Take(key string) Result {
+	now := time.Now()
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	kl.evict(now)
+	e := kl.entry(key, now)
+	res := Result{Limit: kl.cfg.Burst}
+
+	r := e.limiter.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		res.RetryAfter = d
+		res.Reset = d + kl.cfg.Interval*time.Duration(kl.cfg.Burst-1)
+		return res
+	}
+	if kl.global != nil {
+		if d, ok := allow(kl.global, now); !ok {
+			r.CancelAt(now) // not counted for the key either
+			res.Global, res.RetryAfter = true, d
+			res.Remaining, res.Reset = kl.remaining(e.limiter, now)
+			return res
+		}
+	}
+	res.OK = true
+	res.Remaining, res.Reset = kl.remaining(e.limiter, now)
+	return res
+}
+
+// remaining returns the number of tokens of the limiter, and the duration
+// until it is full, by reserving the full burst and canceling it.
+// It must be called with 'mu' locked.
+func (kl *keyedLimiter) remaining(lim *rate.Limiter, now time.Time) (n int, reset time.Duration) {
+	if kl.cfg.Interval <= 0 {
+		return kl.cfg.Burst, 0
+	}
+	r := lim.ReserveN(now, kl.cfg.Burst)
+	reset = r.DelayFrom(now)
+	r.CancelAt(now)
+
+	// round the missing tokens up, with slack for float errors
+	missing := (reset - time.Microsecond + kl.cfg.Interval - 1) / kl.cfg.Interval
+	return kl.cfg.Burst - int(missing), reset
+}
+
+// entry returns the entry of the key, marked as most recently used.
+// It must be called with 'mu' locked.
+func (kl *keyedLimiter) entry(key string, now time.Time) *keyedEntry {
+	if el, ok := kl.keys[key]; ok {
+		kl.lru.MoveToFront(el)
+		e := el.Value.(*keyedEntry)
+		e.lastUsed = now
+		return e
+	}
+
+	if kl.lru.Len() >= kl.cfg.MaxKeys {
+		kl.remove(kl.lru.Back())
+	}
+	e := &keyedEntry{
+		key:      key,
+		limiter:  rate.NewLimiter(rate.Every(kl.cfg.Interval), kl.cfg.Burst),
+		lastUsed: now,
+	}
+	kl.keys[key] = kl.lru.PushFront(e)
+	return e
+}
+
+// evict removes the keys idle for longer than TTL.
+// It must be called with 'mu' locked.
+func (kl *keyedLimiter) evict(now time.Time) {
+	for el := kl.lru.Back(); el != nil; el = kl.lru.Back() {
+		if now.Sub(el.Value.(*keyedEntry).lastUsed) <= kl.cfg.TTL {
+			return
+		}
+		kl.remove(el)
+	}
+}
+
+func (kl *keyedLimiter) remove(el *list.Element) {
+	kl.lru.Remove(el)
+	delete(kl.keys, el.Value.(*keyedEntry).key)
+}
+
+func (kl *keyedLimiter) SetInterval(interval time.Duration) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	kl.cfg.Interval = interval
+	if refill := interval * time.Duration(kl.cfg.Burst); kl.cfg.TTL < refill {
+		kl.cfg.TTL = refill
+	}
+	for el := kl.lru.Front(); el != nil; el = el.Next() {
+		el.Value.(*keyedEntry).limiter.SetLimit(rate.Every(interval))
+	}
+}
+
+func (kl *keyedLimiter) Len() int {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return kl.lru.Len()
+}
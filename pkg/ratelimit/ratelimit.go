@@ -17,7 +17,6 @@ package ratelimit
 import (
 	"context"
 	"fmt"
-	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -26,10 +25,7 @@ import (
 // NewRequestLimiter returns a new RequestLimiter.
 func NewRequestLimiter(rootCtx context.Context, interval time.Duration) RequestLimiter {
 	return &requestLimiter{
-		rootCtx:     rootCtx,
-		lastRequest: time.Time{},
-
-		interval: interval,
+		rootCtx:  rootCtx,
 		minScale: time.Millisecond,
 
 		// allow only 1 request for every interval
@@ -39,99 +35,66 @@ func NewRequestLimiter(rootCtx context.Context, interval time.Duration) RequestL
 
 // RequestLimiter limits requests.
 type RequestLimiter interface {
-	// Check returns true if it's ok to request.
+	// Check returns true if it's ok to request, and counts the request.
+	// Otherwise, it returns the message with the duration to wait.
 	Check() (msg string, ok bool)
-	// Advance must be called after Check.
+	// Allow is Check that returns the exact duration to wait, if not ok.
+	// It returns zero duration if the root context is canceled.
+	Allow() (retryAfter time.Duration, ok bool)
+	// Advance is a no-op.
+	//
+	// Deprecated: Check counts the request itself.
 	Advance()
 	// SetInterval updates the interval.
 	SetInterval(interval time.Duration)
 }
 
+// requestLimiter never blocks: a request reserves a token, and the
+// reservation is canceled if the token is not available right away.
 type requestLimiter struct {
-	mu      sync.RWMutex
-	rootCtx context.Context
-
-	interval time.Duration
+	rootCtx  context.Context
 	minScale time.Duration
 
-	limiter     *rate.Limiter
-	lastRequest time.Time
+	limiter *rate.Limiter // safe for concurrent use
 }
 
 // OkMessage is the message returned when it's ok to request.
 const OkMessage = "OK"
 
-var (
-	canceledMsg = context.Canceled.Error()
-
-	// RootContextCanceled is returned when the parent context was canceled.
-	RootContextCanceled = "root " + canceledMsg
-)
+// RootContextCanceled is returned when the parent context was canceled.
+var RootContextCanceled = "root " + context.Canceled.Error()
 
 func (rl *requestLimiter) Check() (msg string, ok bool) {
-	subctx, subcancel := context.WithCancel(rl.rootCtx) // to signal goroutine exit
-
-	canceled := false
-	wc := make(chan struct{})
-
-	go func(ctx context.Context) {
-		rl.mu.Lock()
-		limiter := rl.limiter
-		rl.mu.Unlock()
-
-		err := limiter.Wait(ctx)
-
-		canceled = err == context.Canceled
-		close(wc)
-	}(subctx)
-
-	select {
-	case <-rl.rootCtx.Done(): // root context is canceled
-		subcancel() // stop rate limiter waiting(blocking)
-
-		<-wc // wait for rate limiter goroutine to return
-
-		msg = "root " + context.Canceled.Error()
-		ok = false
-
-	case <-wc: // ok to request
-		if canceled {
-			msg = context.Canceled.Error()
-			ok = false
-			break
-		}
-		msg = OkMessage
-		ok = true
-
-	case <-time.After(5 * time.Millisecond): // wait up to 5ms; rate limiter is blocking, so it returns message, false
-		subcancel() // stop waiting on rate limiter
-
-		rl.mu.RLock()
-		took := time.Since(rl.lastRequest)
-		rl.mu.RUnlock()
-
-		if rl.interval-took > time.Duration(0) {
-			msg = fmt.Sprintf("rate limit exceeded (try again after %v)", roundDownDuration(rl.interval-took, rl.minScale))
-			ok = false
-			break
-		}
-		msg = OkMessage
-		ok = true
+	if rl.rootCtx.Err() != nil {
+		return RootContextCanceled, false
 	}
+	d, ok := rl.Allow()
+	if !ok {
+		return fmt.Sprintf("rate limit exceeded (try again after %v)", roundDownDuration(d, rl.minScale)), false
+	}
+	return OkMessage, true
+}
 
-	subcancel()
-	return
+func (rl *requestLimiter) Allow() (retryAfter time.Duration, ok bool) {
+	if rl.rootCtx.Err() != nil {
+		return 0, false
+	}
+	return allow(rl.limiter, time.Now())
 }
 
-func (rl *requestLimiter) Advance() {
-	rl.mu.Lock()
-	rl.lastRequest = time.Now()
-	rl.mu.Unlock()
+// allow reserves a token, or returns the duration until it is available
+// without reserving it.
+func allow(lim *rate.Limiter, now time.Time) (retryAfter time.Duration, ok bool) {
+	r := lim.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return d, false
+	}
+	return 0, true
 }
 
+func (rl *requestLimiter) Advance() {}
+
 func (rl *requestLimiter) SetInterval(interval time.Duration) {
-	rl.mu.Lock()
 	rl.limiter.SetLimit(rate.Every(interval))
-	rl.interval = interval
-	rl.mu.Unlock()
 }
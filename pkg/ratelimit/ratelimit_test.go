@@ -17,10 +17,21 @@ package ratelimit
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/etcd-io/etcdlabs/cluster"
+
+	"github.com/coreos/etcd/clientv3"
 )
 
+// basePort is the root port of the next test cluster.
+var basePort uint32 = 3300
+
 func TestRequestLimiter(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	rl := NewRequestLimiter(ctx, time.Second)
@@ -60,3 +71,277 @@ func TestRequestLimiter(t *testing.T) {
 	rl.Advance()
 	fmt.Println("4:", msg)
 }
+
+func TestRequestLimiter_Allow(t *testing.T) {
+	rl := NewRequestLimiter(context.Background(), time.Second)
+	if _, ok := rl.Allow(); !ok {
+		t.Fatal("expected ok")
+	}
+
+	// rejected requests must not be counted
+	for i := 0; i < 3; i++ {
+		d, ok := rl.Allow()
+		if ok {
+			t.Fatalf("#%d: expected rate-limit-excess", i)
+		}
+		if d <= 0 || d > time.Second {
+			t.Fatalf("#%d: expected retry-after in (0, 1s], got %v", i, d)
+		}
+	}
+
+	rl.SetInterval(time.Millisecond)
+	time.Sleep(time.Second)
+	if d, ok := rl.Allow(); !ok {
+		t.Fatalf("expected ok, got retry-after %v", d)
+	}
+}
+
+func TestKeyedLimiter(t *testing.T) {
+	kl := NewKeyedLimiter(KeyedConfig{
+		Interval:       time.Second,
+		Burst:          2,
+		MaxKeys:        2,
+		GlobalInterval: 100 * time.Millisecond,
+		GlobalBurst:    3,
+	})
+
+	// burst of each key
+	for i := 0; i < 2; i++ {
+		if msg, ok := kl.Check("a"); !ok {
+			t.Fatalf("#%d: expected ok, got %q", i, msg)
+		}
+	}
+	if msg, ok := kl.Check("a"); ok {
+		t.Fatalf("expected rate-limit-excess, got %q", msg)
+	}
+
+	// other keys are not limited by "a", up to the global ceiling
+	if msg, ok := kl.Check("b"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	msg, ok := kl.Check("b")
+	if ok {
+		t.Fatalf("expected global rate-limit-excess, got %q", msg)
+	}
+	fmt.Println("global:", msg)
+
+	// request rejected by the global ceiling is not counted for the key
+	time.Sleep(100 * time.Millisecond)
+	if msg, ok := kl.Check("b"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+
+	// least recently used key is evicted
+	time.Sleep(100 * time.Millisecond)
+	if msg, ok := kl.Check("c"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	if n := kl.Len(); n != 2 {
+		t.Fatalf("expected 2 keys, got %d", n)
+	}
+}
+
+func TestKeyedLimiter_ttl(t *testing.T) {
+	kl := NewKeyedLimiter(KeyedConfig{Interval: 100 * time.Millisecond})
+	for _, k := range []string{"a", "b"} {
+		if msg, ok := kl.Check(k); !ok {
+			t.Fatalf("expected ok, got %q", msg)
+		}
+	}
+
+	// idle keys are refilled, so they are evicted
+	time.Sleep(150 * time.Millisecond)
+	if msg, ok := kl.Check("a"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	if n := kl.Len(); n != 1 {
+		t.Fatalf("expected 1 key, got %d", n)
+	}
+}
+
+func TestKeyedLimiter_take(t *testing.T) {
+	kl := NewKeyedLimiter(KeyedConfig{Interval: time.Second, Burst: 3})
+
+	for i, remaining := range []int{2, 1, 0} {
+		res := kl.Take("a")
+		if !res.OK || res.Limit != 3 || res.Remaining != remaining {
+			t.Fatalf("#%d: expected ok with %d remaining, got %+v", i, remaining, res)
+		}
+		if want := time.Duration(3-remaining) * time.Second; res.Reset < want-10*time.Millisecond || res.Reset > want {
+			t.Fatalf("#%d: expected reset about %v, got %v", i, want, res.Reset)
+		}
+	}
+
+	res := kl.Take("a")
+	if res.OK || res.Remaining != 0 || res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Fatalf("expected rate-limit-excess, got %+v", res)
+	}
+	if res.Reset < 2*time.Second || res.Reset > 3*time.Second {
+		t.Fatalf("expected reset in [2s, 3s], got %v", res.Reset)
+	}
+	if msg := res.Message(); !strings.HasPrefix(msg, "rate limit exceeded") {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestEtcdKeyedLimiter(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "ratelimit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCtx, rootCancel := context.WithCancel(context.Background())
+	defer rootCancel()
+	clus, err := cluster.Start(rootCtx, cluster.Config{
+		Size:           1,
+		RootDir:        dir,
+		RootPort:       int(atomic.AddUint32(&basePort, 10)),
+		EmbeddedClient: true,
+		RootCtx:        rootCtx,
+		RootCancel:     rootCancel,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, _, err := clus.Client(clus.Members[0].Endpoints(false)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two servers sharing the state
+	var errs []error
+	cfg := EtcdConfig{
+		KeyedConfig: KeyedConfig{Interval: time.Second, Burst: 2},
+		Client:      cli,
+		Prefix:      "/ratelimit/",
+
+		RequestTimeout: 500 * time.Millisecond,
+		OnError:        func(err error) { errs = append(errs, err) },
+	}
+	kl1, kl2 := NewEtcdKeyedLimiter(cfg), NewEtcdKeyedLimiter(cfg)
+
+	if msg, ok := kl1.Check("a"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	if msg, ok := kl2.Check("a"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	d, ok := kl1.Allow("a")
+	if ok {
+		t.Fatal("expected rate-limit-excess on the other server")
+	}
+	if d <= 0 || d > time.Second {
+		t.Fatalf("expected retry-after in (0, 1s], got %v", d)
+	}
+	if _, ok = kl2.Allow("a"); ok {
+		t.Fatal("expected rate-limit-excess")
+	}
+	if msg, ok := kl2.Check("b"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	if res := kl1.Take("d"); !res.OK || res.Limit != 2 || res.Remaining != 1 {
+		t.Fatalf("expected ok with 1 remaining, got %+v", res)
+	}
+	if n := kl1.Len(); n != 3 {
+		t.Fatalf("expected 3 keys, got %d", n)
+	}
+
+	// the state expires with its lease
+	resp, err := cli.Get(context.Background(), "/ratelimit/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || resp.Kvs[0].Lease == 0 {
+		t.Fatalf("expected a key with lease, got %+v", resp.Kvs)
+	}
+
+	time.Sleep(time.Second)
+	if msg, ok := kl2.Check("a"); !ok {
+		t.Fatalf("expected ok after the interval, got %q", msg)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	// a revoked lease is granted again, after limiting locally once
+	lease := kl1.(*etcdLimiter).lease
+	if _, err = cli.Revoke(context.Background(), lease); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := kl1.Check("e"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error with the revoked lease, got %v", errs)
+	}
+	if msg, ok := kl1.Check("f"); !ok {
+		t.Fatalf("expected ok, got %q", msg)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors %v", errs[1:])
+	}
+	resp, err = cli.Get(context.Background(), "/ratelimit/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || resp.Kvs[0].Lease == 0 || clientv3.LeaseID(resp.Kvs[0].Lease) == lease {
+		t.Fatalf("expected a key with new lease, got %+v", resp.Kvs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = clus.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// fall back to the local limiter without etcd
+	for i := 0; i < 2; i++ {
+		if msg, ok := kl1.Check("c"); !ok {
+			t.Fatalf("#%d: expected ok, got %q", i, msg)
+		}
+	}
+	if msg, ok := kl1.Check("c"); ok {
+		t.Fatalf("expected rate-limit-excess, got %q", msg)
+	}
+	if len(errs) == 0 {
+		t.Fatal("expected errors without etcd")
+	}
+}
+
+func BenchmarkRequestLimiter_Check(b *testing.B) {
+	rl := NewRequestLimiter(context.Background(), time.Hour)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rl.Check()
+	}
+}
+
+func BenchmarkRequestLimiter_Check_parallel(b *testing.B) {
+	rl := NewRequestLimiter(context.Background(), time.Hour)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rl.Check()
+		}
+	})
+}
+
+func BenchmarkKeyedLimiter_Check_parallel(b *testing.B) {
+	kl := NewKeyedLimiter(KeyedConfig{Interval: time.Hour})
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user%d", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			kl.Check(keys[i%len(keys)])
+			i++
+		}
+	})
+}